@@ -0,0 +1,204 @@
+package hath
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// blacklistEntryBytes is length of serialized entry, file(38) + time(8)
+	blacklistEntryBytes = fileBytes + timeBytes
+	blacklistKeyBytes   = timeBytes + HashSize
+
+	// blacklistDefaultPeriod is period of blacklist requested on first sync
+	blacklistDefaultPeriod = time.Hour * 24 * 3
+	blacklistDelimiters    = ";, \t"
+)
+
+var (
+	// dbMetaBlacklistSync is database meta key of last blacklist sync time
+	dbMetaBlacklistSync = []byte("blacklist_sync")
+
+	// ErrBlacklistBadEntry is returned when entry can not be deserialized
+	ErrBlacklistBadEntry = errors.New("Bad blacklist entry")
+)
+
+// BlacklistEntry is info about file removed from cache by blacklist
+type BlacklistEntry struct {
+	File File      `json:"file"`
+	Time time.Time `json:"time"`
+}
+
+// Key is unique key of entry in database, sorted by time of removal
+// time(8) + hash(20)
+func (e BlacklistEntry) Key() []byte {
+	key := make([]byte, blacklistKeyBytes)
+	binary.BigEndian.PutUint64(key[:timeBytes], uint64(e.Time.UnixNano()))
+	copy(key[timeBytes:], e.File.Hash[:])
+	return key
+}
+
+// blacklistKeyStart returns lowest key of entries removed at t
+func blacklistKeyStart(t time.Time) []byte {
+	key := make([]byte, timeBytes)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// Bytes serializes entry into byte slice
+// file(38) + time(8)
+func (e BlacklistEntry) Bytes() []byte {
+	result := make([]byte, blacklistEntryBytes)
+	copy(result[:fileBytes], e.File.Bytes())
+	binary.BigEndian.PutUint64(result[fileBytes:], uint64(e.Time.UnixNano()))
+	return result
+}
+
+// BlacklistEntryFromBytes deserializes entry from byte slice
+func BlacklistEntryFromBytes(data []byte) (e BlacklistEntry, err error) {
+	if len(data) != blacklistEntryBytes {
+		return e, ErrBlacklistBadEntry
+	}
+	if err = FileFromBytesTo(data[:fileBytes], &e.File); err != nil {
+		return e, err
+	}
+	e.Time = time.Unix(0, int64(binary.BigEndian.Uint64(data[fileBytes:])))
+	return e, nil
+}
+
+// ParseBlacklist parses file ids from blacklist response data,
+// skipping invalid ones
+func ParseBlacklist(data []string) (files []File) {
+	for _, line := range data {
+		ids := strings.FieldsFunc(line, func(r rune) bool {
+			return strings.ContainsRune(blacklistDelimiters, r)
+		})
+		for _, id := range ids {
+			f, err := FileFromID(id)
+			if err != nil {
+				log.Println("client:", "bad file id in blacklist:", id)
+				continue
+			}
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// Blacklist requests files that were blacklisted since provided time,
+// blacklist for default period is requested if since is zero
+func (c Client) Blacklist(since time.Time) ([]File, error) {
+	return c.BlacklistContext(context.Background(), since)
+}
+
+// BlacklistContext is Blacklist with context
+func (c Client) BlacklistContext(ctx context.Context, since time.Time) ([]File, error) {
+	period := blacklistDefaultPeriod
+	if !since.IsZero() {
+		period = c.Now().Sub(since)
+	}
+	seconds := int64(period / time.Second)
+	if period%time.Second != 0 {
+		seconds++
+	}
+	r, err := c.getResponse(ctx, actionGetBlacklist, strconv.FormatInt(seconds, intBase))
+	if err != nil {
+		return nil, err
+	}
+	if !r.Success {
+		return nil, ErrUnexpected{Response: r}
+	}
+	return ParseBlacklist(r.Data), nil
+}
+
+// lastBlacklistSync loads time of last blacklist sync from database
+func (s *DefaultServer) lastBlacklistSync() (t time.Time, err error) {
+	data, err := s.db.GetMeta(dbMetaBlacklistSync)
+	if err != nil || len(data) != timeBytes {
+		return t, err
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(data))), nil
+}
+
+// syncBlacklist requests blacklist delta since last sync
+// and removes blacklisted files from cache
+func (s *DefaultServer) syncBlacklist() (removed []File, err error) {
+	since, err := s.lastBlacklistSync()
+	if err != nil {
+		return nil, err
+	}
+	now := s.api.Now()
+	files, err := s.api.Blacklist(since)
+	if err != nil {
+		return nil, err
+	}
+	s.updateLock.Lock()
+	defer s.updateLock.Unlock()
+	for _, f := range files {
+		if !s.db.Exists(f) {
+			continue
+		}
+		if err := s.frontend.Remove(f); err != nil {
+			log.Println("server:", "failed to remove blacklisted file", f, err)
+		}
+		if err := s.db.Remove(f); err != nil {
+			return removed, err
+		}
+		if err := s.db.AddBlacklisted(BlacklistEntry{File: f, Time: now}); err != nil {
+			log.Println("server:", "failed to record blacklisted file", f, err)
+		}
+		log.Println("server:", "removed blacklisted file", f)
+		removed = append(removed, f)
+		s.emit(Event{Type: EventRemoved, File: f, Bytes: f.Size})
+	}
+	if err := s.db.RemoveBlacklistedBefore(now.Add(-s.cfg.BlacklistRetention)); err != nil {
+		log.Println("server:", "failed to remove old blacklist entries", err)
+	}
+	data := make([]byte, timeBytes)
+	binary.BigEndian.PutUint64(data, uint64(now.UnixNano()))
+	return removed, s.db.SetMeta(dbMetaBlacklistSync, data)
+}
+
+func (s *DefaultServer) blacklistLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.cfg.BlacklistInterval)
+	defer ticker.Stop()
+	update := func() {
+		removed, err := s.syncBlacklist()
+		if err != nil {
+			log.Println("server:", "blacklist sync failed:", err)
+			return
+		}
+		log.Println("server:", "blacklist synced, removed files:", len(removed))
+	}
+	if !s.headlessStart {
+		update()
+	}
+	for {
+		select {
+		case <-ticker.C:
+			update()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// handleBlacklist returns files removed by blacklist
+// GET /api/blacklist
+func (s *DefaultServer) handleBlacklist(c *gin.Context) {
+	entries, err := s.db.BlacklistedEntries()
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
@@ -0,0 +1,140 @@
+package hath
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// captureClient responds with same body and records requested urls
+type captureClient struct {
+	body string
+	urls []*url.URL
+}
+
+func (c *captureClient) Get(u string) (*http.Response, error) {
+	req, err := http.NewRequest(httpGET, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+func (c *captureClient) Do(req *http.Request) (*http.Response, error) {
+	c.urls = append(c.urls, req.URL)
+	r := new(http.Response)
+	r.StatusCode = http.StatusOK
+	r.Body = ioutil.NopCloser(bytes.NewBufferString(c.body))
+	return r, nil
+}
+
+func TestBlacklist(t *testing.T) {
+	g := FileGenerator{
+		SizeMax:       randFileSizeMax,
+		SizeMin:       randFileSizeMin,
+		ResolutionMax: randFileResolutionMax,
+		ResolutionMin: randFileResolutionMin,
+	}
+	Convey("Blacklist", t, func() {
+		f := g.NewFake()
+		other := g.NewFake()
+		Convey("Entry", func() {
+			e := BlacklistEntry{File: f, Time: time.Unix(0, 12345)}
+			decoded, err := BlacklistEntryFromBytes(e.Bytes())
+			So(err, ShouldBeNil)
+			So(decoded.File.String(), ShouldEqual, f.String())
+			So(decoded.Time.Equal(e.Time), ShouldBeTrue)
+			_, err = BlacklistEntryFromBytes([]byte("bad"))
+			So(err, ShouldEqual, ErrBlacklistBadEntry)
+		})
+		Convey("Parse", func() {
+			files := ParseBlacklist([]string{f.String() + ";bad;" + other.String(), "", other.String()})
+			So(len(files), ShouldEqual, 3)
+			So(files[0].String(), ShouldEqual, f.String())
+			So(files[1].String(), ShouldEqual, other.String())
+		})
+		Convey("Client", func() {
+			c := NewClient(ClientConfig{})
+			capture := &captureClient{body: "OK\n" + f.String()}
+			c.httpClient = capture
+			files, err := c.Blacklist(time.Time{})
+			So(err, ShouldBeNil)
+			So(len(files), ShouldEqual, 1)
+			So(capture.urls[0].Query().Get(argAction), ShouldEqual, actionGetBlacklist)
+			So(capture.urls[0].Query().Get(argActionArgument), ShouldEqual, "259200")
+			_, err = c.Blacklist(time.Now().Add(-time.Minute))
+			So(err, ShouldBeNil)
+			So(capture.urls[1].Query().Get(argActionArgument), ShouldBeIn, "60", "61")
+		})
+		Convey("Sync", func() {
+			testDir, err := ioutil.TempDir("", randDirPrefix)
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(testDir)
+			db, err := NewDB(path.Join(testDir, "bolt.db"))
+			So(err, ShouldBeNil)
+			c := NewClient(ClientConfig{})
+			capture := &captureClient{body: "OK\n" + f.String() + ";" + other.String()}
+			c.httpClient = capture
+			cfg := ServerConfig{}
+			cfg.Client = c
+			cfg.DataBase = db
+			cfg.Frontend = NewFrontend(testDir)
+			server := NewServer(cfg)
+			server.headlessStart = true
+			So(server.Start(), ShouldBeNil)
+			defer server.Close()
+
+			So(db.Add(f), ShouldBeNil)
+			So(server.frontend.Add(f, bytes.NewReader(make([]byte, f.Size))), ShouldBeNil)
+			removed, err := server.syncBlacklist()
+			So(err, ShouldBeNil)
+			So(len(removed), ShouldEqual, 1)
+			So(db.Exists(f), ShouldBeFalse)
+			_, err = os.Stat(path.Join(testDir, f.Path()))
+			So(os.IsNotExist(err), ShouldBeTrue)
+			entries, err := db.BlacklistedEntries()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+			So(entries[0].File.String(), ShouldEqual, f.String())
+
+			Convey("Delta", func() {
+				last, err := server.lastBlacklistSync()
+				So(err, ShouldBeNil)
+				So(last.IsZero(), ShouldBeFalse)
+				removed, err := server.syncBlacklist()
+				So(err, ShouldBeNil)
+				So(len(removed), ShouldEqual, 0)
+				period := capture.urls[len(capture.urls)-1].Query().Get(argActionArgument)
+				So(strings.TrimLeft(period, "0123456789"), ShouldBeEmpty)
+				So(len(period), ShouldBeLessThanOrEqualTo, 2)
+			})
+			Convey("Retention", func() {
+				So(db.AddBlacklisted(BlacklistEntry{File: other, Time: time.Now().Add(-server.cfg.BlacklistRetention * 2)}), ShouldBeNil)
+				_, err := server.syncBlacklist()
+				So(err, ShouldBeNil)
+				entries, err := db.BlacklistedEntries()
+				So(err, ShouldBeNil)
+				So(len(entries), ShouldEqual, 1)
+				So(entries[0].File.String(), ShouldEqual, f.String())
+			})
+			Convey("Api", func() {
+				req, err := http.NewRequest(httpGET, "/api/blacklist", nil)
+				So(err, ShouldBeNil)
+				req.RemoteAddr = "127.0.0.1:1234"
+				rec := httptest.NewRecorder()
+				server.ServeHTTP(rec, req)
+				So(rec.Code, ShouldEqual, http.StatusOK)
+				So(rec.Body.String(), ShouldContainSubstring, `"file"`)
+			})
+		})
+	})
+}
@@ -1,6 +1,7 @@
 package hath
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
@@ -32,7 +33,7 @@ var (
 
 var (
 	// FileTypes list for allowerd images
-	FileTypes = []string{"jpg", "png", "gif"}
+	FileTypes = []string{"jpg", "png", "gif", "wbp", "wbm", "avf", "jxl"}
 	// FileTypesN count of FileTypes
 	FileTypesN = len(FileTypes)
 )
@@ -79,8 +80,10 @@ func (d *DirectFrontend) Handle(file File, w http.ResponseWriter) error {
 	}
 
 	defer f.Close()
-	w.Header().Add(headerContentType, file.ContentType())
-	n, err := io.Copy(w, f)
+	r := bufio.NewReaderSize(f, sniffLength)
+	head, _ := r.Peek(sniffLength)
+	w.Header().Add(headerContentType, file.SniffContentType(head))
+	n, err := io.Copy(w, r)
 	if n != file.Size {
 		return ErrFileBadLength
 	}
@@ -243,6 +246,11 @@ func (c *FileCache) Scan(results chan File, progress chan Progress) error {
 	var subdirs []*os.File
 	log.Println("openning directories")
 	for _, subdir := range subdirNames {
+		// cache directories are named by file hash prefix
+		if len(subdir) != prefixLenght {
+			log.Println("cache:", "skipping", subdir)
+			continue
+		}
 		d, err := os.Open(path.Join(c.dir, subdir))
 		if err != nil {
 			log.Println("cache:", "bad dir", d.Name(), err)
@@ -276,6 +284,10 @@ func (c *FileCache) Scan(results chan File, progress chan Progress) error {
 				log.Println("cache:", "error while parsing id", file)
 				continue
 			}
+			if f.Type == UnknownImage {
+				log.Println("cache:", "unsupported file type", file)
+				continue
+			}
 			results <- f
 		}
 	}
@@ -0,0 +1,129 @@
+package hath
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	actionGetCertificate = "get_cert"
+
+	// certificateRetryInterval is minimum interval between certificate reloads
+	certificateRetryInterval = time.Minute * 10
+)
+
+var (
+	// ErrNoCertificate is returned when certificate is not loaded yet
+	ErrNoCertificate = errors.New("Certificate is not loaded")
+)
+
+// ParseCertificate parses PEM bundle with certificate chain and private key
+func ParseCertificate(bundle []byte) (cert tls.Certificate, err error) {
+	cert, err = tls.X509KeyPair(bundle, bundle)
+	if err != nil {
+		return cert, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	return cert, err
+}
+
+// Certificate requests certificate bundle issued for client by rpc server
+func (c Client) Certificate() (cert tls.Certificate, err error) {
+	return c.CertificateContext(context.Background())
+}
+
+// CertificateContext is Certificate with context
+func (c Client) CertificateContext(ctx context.Context) (cert tls.Certificate, err error) {
+	r, err := c.getResponse(ctx, actionGetCertificate)
+	if err != nil {
+		return cert, err
+	}
+	if !r.Success {
+		return cert, ErrUnexpected{Response: r}
+	}
+	cert, err = ParseCertificate([]byte(strings.Join(r.Data, "\n")))
+	if err != nil {
+		return cert, ErrUnexpected{Err: err}
+	}
+	log.Println("client:", "got certificate for", cert.Leaf.Subject.CommonName, "valid until", cert.Leaf.NotAfter)
+	return cert, nil
+}
+
+// certificateManager holds current certificate and
+// reloads it from rpc server before it expires
+type certificateManager struct {
+	api         *Client
+	renewBefore time.Duration
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+}
+
+func newCertificateManager(api *Client, renewBefore time.Duration) *certificateManager {
+	return &certificateManager{api: api, renewBefore: renewBefore}
+}
+
+// reload requests new certificate from rpc server
+func (m *certificateManager) reload() error {
+	cert, err := m.api.Certificate()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.certificate = &cert
+	m.mu.Unlock()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (m *certificateManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.certificate == nil {
+		return nil, ErrNoCertificate
+	}
+	return m.certificate, nil
+}
+
+// renewIn returns duration after which certificate should be reloaded
+func (m *certificateManager) renewIn(now time.Time) time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.certificate == nil || m.certificate.Leaf == nil {
+		return certificateRetryInterval
+	}
+	d := m.certificate.Leaf.NotAfter.Add(-m.renewBefore).Sub(now)
+	if d < certificateRetryInterval {
+		return certificateRetryInterval
+	}
+	return d
+}
+
+// TLSConfig returns server tls config that uses current certificate
+func (m *certificateManager) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: m.GetCertificate}
+}
+
+// certificateLoop reloads certificate before expiration
+func (s *DefaultServer) certificateLoop() {
+	defer s.wg.Done()
+	timer := time.NewTimer(s.certificates.renewIn(time.Now()))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			log.Println("server:", "reloading certificate")
+			if err := s.certificates.reload(); err != nil {
+				log.Println("server:", "failed to reload certificate:", err)
+			}
+			timer.Reset(s.certificates.renewIn(time.Now()))
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package hath
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// selfSignedBundle returns PEM bundle with self-signed certificate and key
+func selfSignedBundle(commonName string, notAfter time.Time) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...)
+	return bundle, nil
+}
+
+func TestCertificate(t *testing.T) {
+	Convey("Certificate", t, func() {
+		notAfter := time.Now().Add(time.Hour * 24 * 30).Truncate(time.Second)
+		bundle, err := selfSignedBundle("hath.network", notAfter)
+		So(err, ShouldBeNil)
+		c := NewClient(ClientConfig{})
+		c.httpClient = stubClient{body: "OK\n" + string(bundle)}
+
+		Convey("Parse", func() {
+			cert, err := ParseCertificate(bundle)
+			So(err, ShouldBeNil)
+			So(cert.Leaf.Subject.CommonName, ShouldEqual, "hath.network")
+			_, err = ParseCertificate([]byte("bad"))
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Client", func() {
+			cert, err := c.Certificate()
+			So(err, ShouldBeNil)
+			So(cert.Leaf.NotAfter.Equal(notAfter), ShouldBeTrue)
+			Convey("Fail", func() {
+				c.httpClient = stubClient{body: "FAIL"}
+				_, err := c.Certificate()
+				So(IsUnexpected(err), ShouldBeTrue)
+			})
+			Convey("Bad bundle", func() {
+				c.httpClient = stubClient{body: "OK\nbad"}
+				_, err := c.Certificate()
+				So(IsUnexpected(err), ShouldBeTrue)
+			})
+		})
+		Convey("Manager", func() {
+			m := newCertificateManager(c, time.Hour*24)
+			_, err := m.GetCertificate(nil)
+			So(err, ShouldEqual, ErrNoCertificate)
+			So(m.renewIn(time.Now()), ShouldEqual, certificateRetryInterval)
+			So(m.reload(), ShouldBeNil)
+			cert, err := m.GetCertificate(nil)
+			So(err, ShouldBeNil)
+			So(cert.Leaf.Subject.CommonName, ShouldEqual, "hath.network")
+			now := notAfter.Add(-time.Hour * 48)
+			So(m.renewIn(now), ShouldEqual, time.Hour*24)
+			So(m.renewIn(notAfter), ShouldEqual, certificateRetryInterval)
+
+			Convey("Reload", func() {
+				renewed, err := selfSignedBundle("renewed.hath.network", notAfter.Add(time.Hour))
+				So(err, ShouldBeNil)
+				c.httpClient = stubClient{body: "OK\n" + string(renewed)}
+				So(m.reload(), ShouldBeNil)
+				cert, err := m.GetCertificate(nil)
+				So(err, ShouldBeNil)
+				So(cert.Leaf.Subject.CommonName, ShouldEqual, "renewed.hath.network")
+			})
+			Convey("Reload failure keeps certificate", func() {
+				c.httpClient = stubClient{body: "FAIL"}
+				So(m.reload(), ShouldNotBeNil)
+				_, err := m.GetCertificate(nil)
+				So(err, ShouldBeNil)
+			})
+			Convey("Serve", func() {
+				ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Write([]byte("OK"))
+				}))
+				ts.TLS = m.TLSConfig()
+				ts.StartTLS()
+				defer ts.Close()
+				pool := x509.NewCertPool()
+				pool.AddCert(cert.Leaf)
+				client := &http.Client{Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "hath.network"},
+				}}
+				res, err := client.Get(ts.URL)
+				So(err, ShouldBeNil)
+				defer res.Body.Close()
+				body, err := ioutil.ReadAll(res.Body)
+				So(err, ShouldBeNil)
+				So(string(body), ShouldEqual, "OK")
+			})
+		})
+		Convey("Server", func() {
+			testDir, err := ioutil.TempDir("", randDirPrefix)
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(testDir)
+			db, err := NewDB(path.Join(testDir, "bolt.db"))
+			So(err, ShouldBeNil)
+			cfg := ServerConfig{}
+			cfg.Client = c
+			cfg.DataBase = db
+			cfg.Frontend = NewFrontend(testDir)
+			cfg.TLS = true
+			server := NewServer(cfg)
+			server.headlessStart = true
+			So(server.Start(), ShouldBeNil)
+			defer server.Close()
+			cert, err := server.certificates.GetCertificate(nil)
+			So(err, ShouldBeNil)
+			So(cert.Leaf.Subject.CommonName, ShouldEqual, "hath.network")
+			Convey("Start fails without certificate", func() {
+				c.httpClient = stubClient{body: "FAIL"}
+				server := NewServer(cfg)
+				server.headlessStart = true
+				So(server.Start(), ShouldNotBeNil)
+				So(server.State(), ShouldEqual, StateNew)
+			})
+		})
+	})
+}
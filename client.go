@@ -3,6 +3,7 @@ package hath
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"errors"
 	"fmt"
@@ -20,9 +21,10 @@ const (
 	clientVersion = "1.2.25"
 	clientBuild   = 96
 
-	clientAPIHost   = "rpc.hentaiathome.net"
-	clientAPIScheme = "http"
-	clientAPIPath   = "clientapi.php"
+	clientAPIHost        = "rpc.hentaiathome.net"
+	clientAPIScheme      = "http"
+	clientAPIPath        = "clientapi.php"
+	clientDownloadScheme = "http"
 
 	argClientBuild    = "clientbuild"
 	argAction         = "act"
@@ -85,6 +87,8 @@ var (
 	// ErrClientUnexpectedResponse unexpected/unhandler error
 	ErrClientUnexpectedResponse = errors.New("Unexpected error")
 	// ErrTimeDesync timestamp delta too bit
+	//
+	// Deprecated: time difference is compensated by Client.Clock
 	ErrTimeDesync = errors.New("Time on server and on client differ too much")
 	// ErrClientVersionOld api outdated
 	ErrClientVersionOld = errors.New("Client version is too old")
@@ -112,14 +116,38 @@ type Credentials struct {
 // ClientConfig is configuration for client
 type ClientConfig struct {
 	Credentials
-	Host  string
-	Debug bool
+	Host   string
+	Scheme string
+	Path   string
+	// BaseURL of rpc api, overrides Host, Scheme and Path if set
+	BaseURL *url.URL
+	// DownloadScheme is scheme of file downloads
+	DownloadScheme string
+	Debug          bool
+
+	// Timeout of single rpc request
+	Timeout time.Duration
+	// MaxRetries is count of retries of failed rpc request,
+	// 3 if zero, negative value disables retries
+	MaxRetries int
+	// RetryBackoff is initial delay between retries, doubled on every retry
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// CircuitThreshold is count of consecutive failures
+	// after which rpc server is not used for CircuitCooldown
+	CircuitThreshold int
+	CircuitCooldown  time.Duration
 }
 
 // Client is api for hath rpc
 type Client struct {
 	cfg        ClientConfig
 	httpClient HTTPClient
+	pool       *rpcPool
+	clock      *Clock
+	metrics    *Metrics
+	// onCall is called when rpc call is completed
+	onCall func(action string, duration time.Duration, err error)
 }
 
 // ErrUnexpected error while processing request/response
@@ -154,7 +182,7 @@ func (c Client) getURL(args ...string) *url.URL {
 		action   = args[0]
 		argument = ""
 		sID      = sInt64(c.cfg.ClientID)
-		sTime    = sInt64(time.Now().Unix())
+		sTime    = sInt64(c.clock.Now().Unix())
 		sBuild   = sInt64(clientBuild)
 	)
 
@@ -176,7 +204,7 @@ func (c Client) getURL(args ...string) *url.URL {
 	actionKey := fmt.Sprintf("%x", h.Sum(nil))
 
 	// building url
-	u := &url.URL{Scheme: clientAPIScheme, Path: clientAPIPath, Host: clientAPIHost}
+	u := &url.URL{Scheme: c.cfg.Scheme, Path: c.cfg.Path, Host: c.cfg.Host}
 	values := make(url.Values)
 	values.Add(argClientBuild, sBuild)
 	values.Add(argAction, action)
@@ -193,7 +221,7 @@ func (c Client) ActionURL(args ...string) *url.URL {
 	return c.getURL(args...)
 }
 
-func (c Client) getResponse(args ...string) (r APIResponse, err error) {
+func (c Client) getResponse(ctx context.Context, args ...string) (r APIResponse, err error) {
 	u := c.ActionURL(args...)
 
 	if c.cfg.Debug {
@@ -212,12 +240,73 @@ func (c Client) getResponse(args ...string) (r APIResponse, err error) {
 			log.Println("response:", r)
 		}()
 	}
-	// perform request
-	res, err := c.httpClient.Get(u.String())
+	start := time.Now()
+	defer func() {
+		if c.metrics != nil {
+			c.metrics.Since("hath_rpc_duration_seconds", start, args[0])
+			if err != nil {
+				c.metrics.Add("hath_rpc_errors_total", 1, args[0])
+			}
+		}
+		if c.onCall != nil {
+			c.onCall(args[0], time.Since(start), err)
+		}
+	}()
+	var host string
+	for attempt := 0; ; attempt++ {
+		if host, err = c.pool.pick(time.Now(), host); err != nil {
+			return r, err
+		}
+		// url is generated for every attempt to refresh action key
+		u = c.ActionURL(args...)
+		u.Host = host
+		r, err = c.do(ctx, u)
+		if err == nil {
+			c.pool.success(host)
+			return r, nil
+		}
+		if ctx.Err() != nil {
+			// request is canceled by caller, not by rpc server failure
+			return r, ctx.Err()
+		}
+		c.pool.failure(host, time.Now())
+		if attempt >= c.cfg.MaxRetries {
+			return r, err
+		}
+		wait := backoff(attempt, c.cfg.RetryBackoff, c.cfg.MaxRetryBackoff)
+		log.Println("client:", "request to", host, "failed:", err, "retrying in", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return r, ctx.Err()
+		}
+	}
+}
+
+// do performs single rpc request with timeout
+func (c Client) do(ctx context.Context, u *url.URL) (r APIResponse, err error) {
+	req, err := http.NewRequest(httpGET, u.String(), nil)
+	if err != nil {
+		return r, err
+	}
+	if u.Host != c.cfg.Host {
+		// failover to rpc server ip, keeping virtual host
+		req.Host = c.cfg.Host
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+	start := time.Now()
+	res, err := c.httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return r, err
 	}
 	defer res.Body.Close()
+	if serverTime, err := http.ParseTime(res.Header.Get("Date")); err == nil {
+		c.clock.Update(serverTime, start, time.Now())
+	}
+	if res.StatusCode >= http.StatusInternalServerError {
+		return r, ErrUnexpected{Err: fmt.Errorf("Unexpected status %d", res.StatusCode)}
+	}
 
 	// read response
 	scanner := bufio.NewScanner(res.Body)
@@ -225,6 +314,9 @@ func (c Client) getResponse(args ...string) (r APIResponse, err error) {
 	for scanner.Scan() {
 		lines = append(lines, scanner.Text())
 	}
+	if err := scanner.Err(); err != nil {
+		return r, err
+	}
 	if len(lines) == 0 {
 		return r, err
 	}
@@ -240,7 +332,12 @@ func (c Client) getResponse(args ...string) (r APIResponse, err error) {
 
 // Start starts api client
 func (c Client) Start() error {
-	r, err := c.getResponse(actionStart)
+	return c.StartContext(context.Background())
+}
+
+// StartContext is Start with context
+func (c Client) StartContext(ctx context.Context) error {
+	r, err := c.getResponse(ctx, actionStart)
 	if err != nil {
 		return err
 	}
@@ -264,12 +361,17 @@ func (c Client) Start() error {
 
 // Login performs sync check and authentication
 func (c Client) Login() error {
+	return c.LoginContext(context.Background())
+}
+
+// LoginContext is Login with context
+func (c Client) LoginContext(ctx context.Context) error {
 	log.Println("client:", "checking sync")
-	if err := c.CheckStats(); err != nil {
+	if err := c.CheckStatsContext(ctx); err != nil {
 		return err
 	}
 	log.Println("client:", "performing authentication")
-	r, err := c.getResponse(actionLogin)
+	r, err := c.getResponse(ctx, actionLogin)
 	if err != nil || !r.Success {
 		return ErrUnexpected{Response: r, Err: err}
 	}
@@ -279,31 +381,66 @@ func (c Client) Login() error {
 
 // StillAlive sends heartbeat
 func (c Client) StillAlive() error {
-	return c.notify(actionStillAlive)
+	return c.StillAliveContext(context.Background())
+}
+
+// StillAliveContext is StillAlive with context
+func (c Client) StillAliveContext(ctx context.Context) error {
+	return c.notify(ctx, actionStillAlive)
 }
 
 // Suspend server
 func (c Client) Suspend() error {
-	return c.notify(actionSuspend)
+	return c.SuspendContext(context.Background())
+}
+
+// SuspendContext is Suspend with context
+func (c Client) SuspendContext(ctx context.Context) error {
+	return c.notify(ctx, actionSuspend)
 }
 
 // Resume server
 func (c Client) Resume() error {
-	return c.notify(actionResume)
+	return c.ResumeContext(context.Background())
+}
+
+// ResumeContext is Resume with context
+func (c Client) ResumeContext(ctx context.Context) error {
+	return c.notify(ctx, actionResume)
 }
 
 // Close server
 func (c Client) Close() error {
-	return c.notify(actionStop)
+	return c.CloseContext(context.Background())
+}
+
+// CloseContext is Close with context
+func (c Client) CloseContext(ctx context.Context) error {
+	return c.notify(ctx, actionStop)
 }
 
 // More files
 func (c Client) More() error {
-	return c.notify(actionMoreFiles)
+	return c.MoreContext(context.Background())
+}
+
+// MoreContext is More with context
+func (c Client) MoreContext(ctx context.Context) error {
+	return c.notify(ctx, actionMoreFiles)
+}
+
+// Overload notifies that server is overloaded
+func (c Client) Overload() error {
+	return c.OverloadContext(context.Background())
 }
 
-func (c Client) notify(action string) error {
-	r, err := c.getResponse(action)
+// OverloadContext is Overload with context
+func (c Client) OverloadContext(ctx context.Context) error {
+	return c.notify(ctx, actionOverload)
+}
+
+func (c Client) notify(ctx context.Context, action string) error {
+	r, err := c.getResponse(ctx, action)
 	if err != nil {
 		return err
 	}
@@ -315,12 +452,17 @@ func (c Client) notify(action string) error {
 
 // Tokens issues requests to obtain tokens for downloading files
 func (c Client) Tokens(files []File) (result map[string]string, err error) {
+	return c.TokensContext(context.Background(), files)
+}
+
+// TokensContext is Tokens with context
+func (c Client) TokensContext(ctx context.Context, files []File) (result map[string]string, err error) {
 	result = make(map[string]string)
 	buff := new(bytes.Buffer)
 	for _, f := range files {
 		buff.WriteString(fmt.Sprintf("%s;", f))
 	}
-	r, err := c.getResponse(actionTokens, buff.String())
+	r, err := c.getResponse(ctx, actionTokens, buff.String())
 	if err != nil {
 		return nil, err
 	}
@@ -402,26 +544,30 @@ func (v Vars) GetProxyMode(k string) (p ProxyMode, err error) {
 	return ProxyMode(modeInt), nil
 }
 
-// CheckStats checks time desync and minumum client build
-// returns nil, of time is synced and client version is up to date
+// CheckStats measures time offset to rpc server and checks minumum client build
+// returns nil, if client version is up to date
 func (c Client) CheckStats() error {
-	r, err := c.getResponse(actionStatistics)
+	return c.CheckStatsContext(context.Background())
+}
+
+// CheckStatsContext is CheckStats with context
+func (c Client) CheckStatsContext(ctx context.Context) error {
+	start := time.Now()
+	r, err := c.getResponse(ctx, actionStatistics)
 	if err != nil {
 		return err
 	}
+	end := time.Now()
 	vars := r.ParseVars()
 	serverTime, err := vars.GetInt64(statTime)
 	if err != nil {
 		return ErrUnexpected{Response: r, Err: err}
 	}
-	delta := time.Now().Unix() - serverTime
-	if delta < 0 {
-		delta *= -1
-	}
-	if delta > maximumTimeLag {
-		return ErrTimeDesync
-	}
-	if delta == 0 {
+	c.clock.Update(time.Unix(serverTime, 0), start, end)
+	offset := c.clock.Offset()
+	if offset > maximumTimeLag*time.Second || offset < -maximumTimeLag*time.Second {
+		log.Println("client:", "warning: local time differs from rpc server by", offset, "and will be corrected")
+	} else if offset == 0 {
 		log.Println("your time is perfectly synced")
 	}
 	serverMinBuild, err := vars.GetInt(statMinBuild)
@@ -466,7 +612,12 @@ func (s Settings) IsRPCServer(r *http.Request) bool {
 
 // Settings from server
 func (c Client) Settings() (cfg Settings, err error) {
-	r, err := c.getResponse(actionSettings)
+	return c.SettingsContext(context.Background())
+}
+
+// SettingsContext is Settings with context
+func (c Client) SettingsContext(ctx context.Context) (cfg Settings, err error) {
+	r, err := c.getResponse(ctx, actionSettings)
 	if err != nil {
 		return cfg, err
 	}
@@ -509,6 +660,7 @@ func (c Client) Settings() (cfg Settings, err error) {
 		}
 		cfg.RPCServers = append(cfg.RPCServers, ip)
 	}
+	c.pool.setServers(cfg.RPCServers)
 	log.Println("got settings:")
 	log.Println("\tstatic ranges:", cfg.StaticRanges)
 	log.Println("\tproxy mode:", cfg.ProxyMode)
@@ -520,9 +672,42 @@ func (c Client) Settings() (cfg Settings, err error) {
 	return cfg, err
 }
 
+// Now returns current time corrected by offset to rpc server time
+func (c Client) Now() time.Time {
+	return c.clock.Now()
+}
+
+// Clock returns clock of client
+func (c Client) Clock() *Clock {
+	return c.clock
+}
+
+// DownloadScheme returns scheme for file downloads
+func (c Client) DownloadScheme() string {
+	return c.cfg.DownloadScheme
+}
+
+// resolveURL returns copy of u with missing scheme set to
+// download scheme and missing host set to rpc host
+func (c Client) resolveURL(u *url.URL) *url.URL {
+	resolved := *u
+	if len(resolved.Scheme) == 0 {
+		resolved.Scheme = c.cfg.DownloadScheme
+	}
+	if len(resolved.Host) == 0 {
+		resolved.Host = c.cfg.Host
+	}
+	return &resolved
+}
+
 // RequestFile from hath server
 func (c Client) RequestFile(f File, u *url.URL) (rc io.ReadCloser, err error) {
-	req, err := http.NewRequest(httpGET, u.String(), nil)
+	return c.RequestFileContext(context.Background(), f, u)
+}
+
+// RequestFileContext is RequestFile with context
+func (c Client) RequestFileContext(ctx context.Context, f File, u *url.URL) (rc io.ReadCloser, err error) {
+	req, err := http.NewRequest(httpGET, c.resolveURL(u).String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -532,35 +717,63 @@ func (c Client) RequestFile(f File, u *url.URL) (rc io.ReadCloser, err error) {
 	hashed := hashStrings(c.cfg.Key, f.String())
 	req.Header.Add("Hath-Request", fmt.Sprintf("%d-%s", c.cfg.ClientID, hashed))
 
-	res, err := c.httpClient.Do(req)
+	res, err := c.httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		log.Println("client:", "request of", f, "failed with status", res.StatusCode)
+		return nil, ErrUnexpected{Err: errors.New("Unexpected status")}
+	}
 
-	return res.Body, nil
+	return c.body(res), nil
+}
+
+// body returns body of file response that is counted in metrics
+func (c Client) body(res *http.Response) io.ReadCloser {
+	if c.metrics == nil {
+		return res.Body
+	}
+	return &countingReadCloser{ReadCloser: res.Body, metrics: c.metrics}
 }
 
 // GetFile returns io.ReadCloser for given url
 func (c Client) GetFile(u *url.URL) (rc io.ReadCloser, err error) {
-	res, err := c.httpClient.Get(u.String())
+	return c.GetFileContext(context.Background(), u)
+}
+
+// GetFileContext is GetFile with context
+func (c Client) GetFileContext(ctx context.Context, u *url.URL) (rc io.ReadCloser, err error) {
+	req, err := http.NewRequest(httpGET, c.resolveURL(u).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
 	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
 		return nil, ErrUnexpected{Err: errors.New("Unexpected status")}
 	}
-	log.Println("client:", "downloading from", res.Request.URL.Host)
-	return res.Body, nil
+	log.Println("client:", "downloading from", req.URL.Host)
+	return c.body(res), nil
 }
 
 // RemoveFiles notifies api server of removed files
 func (c Client) RemoveFiles(files []File) error {
+	return c.RemoveFilesContext(context.Background(), files)
+}
+
+// RemoveFilesContext is RemoveFiles with context
+func (c Client) RemoveFilesContext(ctx context.Context, files []File) error {
 	count := len(files)
 	if count > maxRemoveCount {
 		// removing files in batches of maxRemoveCount
 		var index int
 		for index = 0; index < count; index += maxRemoveCount {
-			if err := c.RemoveFiles(files[index : index+maxRemoveCount]); err != nil {
+			if err := c.RemoveFilesContext(ctx, files[index:index+maxRemoveCount]); err != nil {
 				return err
 			}
 		}
@@ -572,7 +785,7 @@ func (c Client) RemoveFiles(files []File) error {
 		idList[i] = f.String()
 	}
 	arg := strings.Join(idList, fileIDDelimiter)
-	r, err := c.getResponse(actionRemove, arg)
+	r, err := c.getResponse(ctx, actionRemove, arg)
 	if err != nil {
 		return err
 	}
@@ -584,12 +797,17 @@ func (c Client) RemoveFiles(files []File) error {
 
 // AddFiles notifies api server of registered files
 func (c Client) AddFiles(files []File) error {
+	return c.AddFilesContext(context.Background(), files)
+}
+
+// AddFilesContext is AddFiles with context
+func (c Client) AddFilesContext(ctx context.Context, files []File) error {
 	count := len(files)
 	if count > maxRemoveCount {
 		// adding files in batches of maxRemoveCount
 		var index int
 		for index = 0; index < count; index += maxRemoveCount {
-			if err := c.AddFiles(files[index : index+maxRemoveCount]); err != nil {
+			if err := c.AddFilesContext(ctx, files[index:index+maxRemoveCount]); err != nil {
 				return err
 			}
 		}
@@ -601,7 +819,7 @@ func (c Client) AddFiles(files []File) error {
 		idList[i] = f.String()
 	}
 	arg := strings.Join(idList, fileIDDelimiter)
-	r, err := c.getResponse(actionFileAdd, arg)
+	r, err := c.getResponse(ctx, actionFileAdd, arg)
 	if err != nil {
 		return err
 	}
@@ -614,10 +832,79 @@ func (c Client) AddFiles(files []File) error {
 // NewClient creates new client for api
 func NewClient(cfg ClientConfig) *Client {
 	c := new(Client)
+	if cfg.BaseURL != nil {
+		if len(cfg.BaseURL.Scheme) != 0 {
+			cfg.Scheme = cfg.BaseURL.Scheme
+		}
+		if len(cfg.BaseURL.Host) != 0 {
+			cfg.Host = cfg.BaseURL.Host
+		}
+		if len(cfg.BaseURL.Path) != 0 {
+			cfg.Path = cfg.BaseURL.Path
+		}
+	}
 	if len(cfg.Host) == 0 {
 		cfg.Host = clientAPIHost
 	}
+	if len(cfg.Scheme) == 0 {
+		cfg.Scheme = clientAPIScheme
+	}
+	if len(cfg.Path) == 0 {
+		cfg.Path = clientAPIPath
+	}
+	if len(cfg.DownloadScheme) == 0 {
+		cfg.DownloadScheme = clientDownloadScheme
+	}
+	if cfg.Timeout == time.Second*0 {
+		cfg.Timeout = time.Second * 30
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryBackoff == time.Second*0 {
+		cfg.RetryBackoff = time.Millisecond * 500
+	}
+	if cfg.MaxRetryBackoff == time.Second*0 {
+		cfg.MaxRetryBackoff = time.Second * 30
+	}
+	if cfg.CircuitThreshold == 0 {
+		cfg.CircuitThreshold = 5
+	}
+	if cfg.CircuitCooldown == time.Second*0 {
+		cfg.CircuitCooldown = time.Minute
+	}
 	c.cfg = cfg
-	c.httpClient = http.DefaultClient
+	c.httpClient = newHTTPClient(cfg.Timeout)
+	c.pool = newRPCPool(cfg.Host, cfg.CircuitThreshold, cfg.CircuitCooldown)
+	c.clock = new(Clock)
 	return c
 }
+
+// newHTTPClient returns http client with dedicated transport, total
+// duration of requests is limited by context, because file downloads
+// can take much longer than rpc calls
+func newHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: time.Second * 30,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			IdleConnTimeout:       time.Second * 90,
+			MaxIdleConnsPerHost:   8,
+		},
+	}
+}
+
+// instrumented returns copy of client that shares its configuration,
+// transport and rpc servers, but reports calls to metrics and onCall
+func (c *Client) instrumented(metrics *Metrics, onCall func(action string, duration time.Duration, err error)) *Client {
+	clone := *c
+	clone.metrics = metrics
+	clone.onCall = onCall
+	return &clone
+}
@@ -2,10 +2,12 @@ package hath
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
 	"testing"
 	"time"
@@ -54,10 +56,51 @@ func TestClientURL(t *testing.T) {
 			So(query.Get("add"), ShouldEqual, arg)
 			So(query.Get("act"), ShouldEqual, action)
 			So(query.Get("clientbuild"), ShouldEqual, strconv.FormatInt(clientBuild, 10))
+			So(u.Scheme, ShouldEqual, clientAPIScheme)
+			So(u.Host, ShouldEqual, clientAPIHost)
+			So(u.Path, ShouldEqual, clientAPIPath)
+		})
+		Convey("Configured", func() {
+			c := NewClient(ClientConfig{Host: "localhost:8080", Scheme: "https", Path: "/rpc"})
+			u := c.getURL("action")
+			So(u.String(), ShouldStartWith, "https://localhost:8080/rpc?")
+			Convey("Base URL", func() {
+				base, err := url.Parse("http://staging.local/api/clientapi.php")
+				So(err, ShouldBeNil)
+				c := NewClient(ClientConfig{Host: "localhost:8080", Scheme: "https", BaseURL: base})
+				u := c.getURL("action")
+				So(u.String(), ShouldStartWith, "http://staging.local/api/clientapi.php?")
+			})
+			Convey("Downloads", func() {
+				rec := &recordingClient{}
+				c.httpClient = rec
+				c.GetFile(&url.URL{Path: "/image.php"})
+				So(rec.url, ShouldEqual, "http://localhost:8080/image.php")
+				c.cfg.DownloadScheme = "https"
+				c.GetFile(&url.URL{Host: "192.0.2.1:443", Path: "/image.php"})
+				So(rec.url, ShouldEqual, "https://192.0.2.1:443/image.php")
+				c.RequestFile(File{}, &url.URL{Host: "192.0.2.1", Path: "/r/file"})
+				So(rec.url, ShouldEqual, "https://192.0.2.1/r/file")
+			})
 		})
 	})
 }
 
+// recordingClient records url of last request and fails it
+type recordingClient struct {
+	url string
+}
+
+func (r *recordingClient) Get(url string) (*http.Response, error) {
+	r.url = url
+	return nil, errors.New("recorded")
+}
+
+func (r *recordingClient) Do(req *http.Request) (*http.Response, error) {
+	r.url = req.URL.String()
+	return nil, errors.New("recorded")
+}
+
 func TestParseVars(t *testing.T) {
 	Convey("Parsing vars", t, func() {
 		res := APIResponse{}
@@ -115,7 +158,7 @@ func TestClientRequest(t *testing.T) {
 		key       = "123fsdyfh12344AFc"
 		tc  *testClient
 	)
-	cfg := ClientConfig{Credentials: Credentials{cid, key}}
+	cfg := ClientConfig{Credentials: Credentials{cid, key}, RetryBackoff: time.Millisecond}
 	c := NewClient(cfg)
 	tc = new(testClient)
 	c.httpClient = tc
@@ -126,7 +169,7 @@ func TestClientRequest(t *testing.T) {
 			responce.StatusCode = http.StatusOK
 			responce.Body = ioutil.NopCloser(bytes.NewBufferString(body))
 			c.httpClient = testClient{nil, responce, nil}
-			r, err := c.getResponse("action")
+			r, err := c.getResponse(context.Background(), "action")
 			So(err, ShouldBeNil)
 			So(r.Success, ShouldBeTrue)
 		})
@@ -136,7 +179,7 @@ func TestClientRequest(t *testing.T) {
 			responce.StatusCode = http.StatusOK
 			responce.Body = ioutil.NopCloser(bytes.NewBufferString(body))
 			c.httpClient = testClient{nil, responce, nil}
-			r, err := c.getResponse("action")
+			r, err := c.getResponse(context.Background(), "action")
 			So(err, ShouldBeNil)
 			So(r.Success, ShouldBeFalse)
 		})
@@ -146,7 +189,7 @@ func TestClientRequest(t *testing.T) {
 			responce.StatusCode = http.StatusOK
 			responce.Body = ioutil.NopCloser(bytes.NewBufferString(body))
 			c.httpClient = testClient{nil, responce, errors.New("test")}
-			r, err := c.getResponse("action")
+			r, err := c.getResponse(context.Background(), "action")
 			So(err, ShouldNotBeNil)
 			So(r.Success, ShouldBeFalse)
 		})
@@ -265,3 +308,45 @@ func TestClientRequest(t *testing.T) {
 		})
 	})
 }
+
+// blockingClient blocks requests until their context is done
+type blockingClient struct{}
+
+func (blockingClient) Get(url string) (*http.Response, error) {
+	return nil, errors.New("request without context")
+}
+
+func (blockingClient) Do(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestClientContext(t *testing.T) {
+	Convey("Client context", t, func() {
+		c := NewClient(ClientConfig{RetryBackoff: time.Millisecond, CircuitThreshold: 1})
+		c.httpClient = blockingClient{}
+		Convey("Canceled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			So(c.StillAliveContext(ctx), ShouldEqual, context.Canceled)
+			// cancellation is not failure of rpc server
+			host, err := c.pool.pick(time.Now(), "")
+			So(err, ShouldBeNil)
+			So(host, ShouldEqual, clientAPIHost)
+		})
+		Convey("Deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+			defer cancel()
+			_, err := c.GetFileContext(ctx, &url.URL{Host: "192.0.2.1", Path: "/image.php"})
+			So(err, ShouldEqual, context.DeadlineExceeded)
+			_, err = c.RequestFileContext(ctx, File{}, &url.URL{Host: "192.0.2.1", Path: "/r/file"})
+			So(err, ShouldEqual, context.DeadlineExceeded)
+		})
+		Convey("Timeout", func() {
+			c.cfg.Timeout = time.Millisecond * 10
+			c.cfg.MaxRetries = 0
+			So(c.StillAlive(), ShouldEqual, context.DeadlineExceeded)
+			So(c.StillAlive(), ShouldEqual, ErrRPCUnavailable)
+		})
+	})
+}
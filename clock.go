@@ -0,0 +1,55 @@
+package hath
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// clockTolerance is maximum difference between measured and current
+// offset that is ignored, because server time has precision of second
+const clockTolerance = time.Second
+
+// Clock is local clock corrected by offset to time of rpc server
+type Clock struct {
+	offset int64 // atomic, nanoseconds
+}
+
+// Now returns corrected time
+func (c *Clock) Now() time.Time {
+	return time.Now().Add(c.Offset())
+}
+
+// Offset returns difference between rpc server time and local time
+func (c *Clock) Offset() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.offset))
+}
+
+// SetOffset sets difference between rpc server time and local time
+func (c *Clock) SetOffset(d time.Duration) {
+	atomic.StoreInt64(&c.offset, int64(d))
+}
+
+// Measure calculates offset from server time that was received in
+// response to request sent at local time start and completed at end
+func (c *Clock) Measure(server, start, end time.Time) time.Duration {
+	// server time is truncated to seconds
+	server = server.Add(time.Second / 2)
+	local := start.Add(end.Sub(start) / 2)
+	return server.Sub(local)
+}
+
+// Update sets offset measured from server time if it differs
+// from current offset more than tolerance
+func (c *Clock) Update(server, start, end time.Time) {
+	offset := c.Measure(server, start, end)
+	delta := offset - c.Offset()
+	if delta < 0 {
+		delta *= -1
+	}
+	if delta <= clockTolerance {
+		return
+	}
+	log.Println("client:", "time offset to rpc server is", offset.Truncate(time.Millisecond))
+	c.SetOffset(offset)
+}
@@ -0,0 +1,48 @@
+package hath
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClock(t *testing.T) {
+	Convey("Clock", t, func() {
+		c := new(Clock)
+		So(c.Offset(), ShouldEqual, 0)
+		start := time.Unix(1000, 0)
+		end := start.Add(time.Second * 2)
+		So(c.Measure(time.Unix(1001, 0), start, end), ShouldEqual, time.Second/2)
+		So(c.Measure(time.Unix(4601, 0), start, end), ShouldEqual, time.Hour+time.Second/2)
+		Convey("Update", func() {
+			c.Update(time.Unix(1001, 0), start, end)
+			So(c.Offset(), ShouldEqual, 0)
+			c.Update(time.Unix(4601, 0), start, end)
+			So(c.Offset(), ShouldEqual, time.Hour+time.Second/2)
+			So(c.Now().Sub(time.Now()), ShouldBeGreaterThan, time.Hour-time.Second)
+			c.Update(time.Unix(4600, 0), start, end)
+			So(c.Offset(), ShouldEqual, time.Hour+time.Second/2)
+		})
+		Convey("Client", func() {
+			client := NewClient(ClientConfig{})
+			serverTime := time.Now().Add(-time.Hour).Unix()
+			body := fmt.Sprintf("OK\nmin_client_build=%d\nserver_time=%d\n", clientBuild, serverTime)
+			client.httpClient = stubClient{body: body}
+			So(client.CheckStats(), ShouldBeNil)
+			offset := client.Clock().Offset()
+			So(offset, ShouldBeBetween, -time.Hour-time.Second*2, -time.Hour+time.Second*2)
+			acttime, err := strconv.ParseInt(client.getURL("action").Query().Get(argTime), 10, 64)
+			So(err, ShouldBeNil)
+			So(acttime, ShouldBeBetweenOrEqual, serverTime-2, serverTime+2)
+			Convey("Timestamps", func() {
+				s := new(DefaultServer)
+				s.api = client
+				So(s.isDeltaValid(sInt64(serverTime)), ShouldBeTrue)
+				So(s.isDeltaValid(sInt64(time.Now().Unix())), ShouldBeFalse)
+			})
+		})
+	})
+}
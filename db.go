@@ -18,9 +18,14 @@ const (
 )
 
 var (
-	dbFileBucket      = []byte("files")
-	dbTimeIndexBucket = []byte("last_usage")
-	dbOptions         = bolt.Options{Timeout: 1 * time.Second}
+	dbFileBucket       = []byte("files")
+	dbTimeIndexBucket  = []byte("last_usage")
+	dbQuarantineBucket = []byte("quarantine")
+	dbBlacklistBucket  = []byte("blacklist")
+	dbMetaBucket       = []byte("meta")
+	dbQueueBucket      = []byte("queue")
+	dbStatsBucket      = []byte("stats")
+	dbOptions          = bolt.Options{Timeout: 1 * time.Second}
 )
 
 // DataBase is interface for storing info about files in some DB
@@ -39,6 +44,32 @@ type DataBase interface {
 	Exists(f File) bool
 	Get(id []byte) (File, error)
 	GetBatch(files chan File, max int64) (err error)
+
+	AddQuarantined(e QuarantineEntry) error
+	GetQuarantined(id []byte) (QuarantineEntry, error)
+	RemoveQuarantined(id []byte) error
+	QuarantinedEntries() ([]QuarantineEntry, error)
+
+	AddBlacklisted(e BlacklistEntry) error
+	BlacklistedEntries() ([]BlacklistEntry, error)
+	// RemoveBlacklistedBefore deletes entries removed before deadline
+	RemoveBlacklistedBefore(deadline time.Time) error
+
+	// AddQueued saves queue entry, replacing entry of same file
+	AddQueued(e QueueEntry) error
+	GetQueued(f File) (QueueEntry, error)
+	RemoveQueued(f File) error
+	QueuedEntries() ([]QueueEntry, error)
+
+	// SetStats saves statistics record, replacing record of same key
+	SetStats(key, value []byte) error
+	RemoveStats(key []byte) error
+	// StatsRecords returns all statistics records by key
+	StatsRecords() (map[string][]byte, error)
+
+	// GetMeta returns nil value if key is not found
+	GetMeta(key []byte) ([]byte, error)
+	SetMeta(key, value []byte) error
 }
 
 // BoltDB stores info about files in cache
@@ -53,13 +84,15 @@ type BoltDB struct {
 type LevelDB struct {
 	files *leveldb.DB
 	index *leveldb.DB
+	meta  *leveldb.DB
 }
 
-// NewLevelDB creates dbPath.files and dbPath.index dbs
+// NewLevelDB creates dbPath.files, dbPath.index and dbPath.meta dbs
 func NewLevelDB(dbPath string) (d *LevelDB, err error) {
 	d = new(LevelDB)
 	fileDB := dbPath + ".files"
 	indexDB := dbPath + ".index"
+	metaDB := dbPath + ".meta"
 
 	files, err := leveldb.OpenFile(fileDB, nil)
 	if err != nil {
@@ -73,6 +106,12 @@ func NewLevelDB(dbPath string) (d *LevelDB, err error) {
 	}
 	d.index = index
 
+	meta, err := leveldb.OpenFile(metaDB, nil)
+	if err != nil {
+		return nil, err
+	}
+	d.meta = meta
+
 	return d, nil
 }
 
@@ -179,6 +218,9 @@ func (db LevelDB) RemoveBatch(files []File) error {
 }
 
 func (db LevelDB) Close() error {
+	if err := db.meta.Close(); err != nil {
+		return err
+	}
 	if err := db.index.Close(); err != nil {
 		return err
 	}
@@ -267,6 +309,26 @@ func NewDB(dbPath string) (d *BoltDB, err error) {
 	if err != nil {
 		return
 	}
+	_, err = tx.CreateBucketIfNotExists(dbQuarantineBucket)
+	if err != nil {
+		return
+	}
+	_, err = tx.CreateBucketIfNotExists(dbBlacklistBucket)
+	if err != nil {
+		return
+	}
+	_, err = tx.CreateBucketIfNotExists(dbQueueBucket)
+	if err != nil {
+		return
+	}
+	_, err = tx.CreateBucketIfNotExists(dbStatsBucket)
+	if err != nil {
+		return
+	}
+	_, err = tx.CreateBucketIfNotExists(dbMetaBucket)
+	if err != nil {
+		return
+	}
 	if err = tx.Commit(); err != nil {
 		return
 	}
@@ -634,3 +696,313 @@ func (d BoltDB) Get(id []byte) (f File, err error) {
 
 	return f, d.deserialize(id, data, &f)
 }
+
+// AddQuarantined saves quarantine entry info
+func (d BoltDB) AddQuarantined(e QuarantineEntry) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbQuarantineBucket).Put(e.Key(), e.Bytes())
+	})
+}
+
+// GetQuarantined loads quarantine entry with provided key
+func (d BoltDB) GetQuarantined(id []byte) (e QuarantineEntry, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(dbQuarantineBucket).Get(id)
+		if len(data) == 0 {
+			return ErrQuarantineNotFound
+		}
+		// data is valid only inside transaction
+		e, err = QuarantineEntryFromBytes(data)
+		return err
+	})
+	return e, err
+}
+
+// RemoveQuarantined deletes quarantine entry info
+func (d BoltDB) RemoveQuarantined(id []byte) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbQuarantineBucket).Delete(id)
+	})
+}
+
+// QuarantinedEntries returns all quarantine entries, oldest first
+func (d BoltDB) QuarantinedEntries() (entries []QuarantineEntry, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbQuarantineBucket).ForEach(func(k []byte, v []byte) error {
+			e, err := QuarantineEntryFromBytes(v)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (db LevelDB) AddQuarantined(e QuarantineEntry) error {
+	return db.meta.Put(dbMetaKey(dbQuarantineBucket, e.Key()), e.Bytes(), nil)
+}
+
+func (db LevelDB) GetQuarantined(id []byte) (e QuarantineEntry, err error) {
+	data, err := db.meta.Get(dbMetaKey(dbQuarantineBucket, id), nil)
+	if err == leveldb.ErrNotFound {
+		return e, ErrQuarantineNotFound
+	}
+	if err != nil {
+		return e, err
+	}
+	return QuarantineEntryFromBytes(data)
+}
+
+func (db LevelDB) RemoveQuarantined(id []byte) error {
+	return db.meta.Delete(dbMetaKey(dbQuarantineBucket, id), nil)
+}
+
+func (db LevelDB) QuarantinedEntries() (entries []QuarantineEntry, err error) {
+	iter := db.meta.NewIterator(util.BytesPrefix(dbMetaKey(dbQuarantineBucket, nil)), nil)
+	for iter.Next() {
+		e, err := QuarantineEntryFromBytes(iter.Value())
+		if err != nil {
+			iter.Release()
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	iter.Release()
+	return entries, iter.Error()
+}
+
+// AddBlacklisted saves info about file removed by blacklist
+func (d BoltDB) AddBlacklisted(e BlacklistEntry) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbBlacklistBucket).Put(e.Key(), e.Bytes())
+	})
+}
+
+// BlacklistedEntries returns all files removed by blacklist, oldest first
+func (d BoltDB) BlacklistedEntries() (entries []BlacklistEntry, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbBlacklistBucket).ForEach(func(k []byte, v []byte) error {
+			e, err := BlacklistEntryFromBytes(v)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// RemoveBlacklistedBefore deletes blacklist entries older than deadline
+func (d BoltDB) RemoveBlacklistedBefore(deadline time.Time) error {
+	end := blacklistKeyStart(deadline)
+	return d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(dbBlacklistBucket)
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetMeta returns copy of meta value
+func (d BoltDB) GetMeta(key []byte) (value []byte, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(dbMetaBucket).Get(key); data != nil {
+			value = append([]byte(nil), data...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// SetMeta saves meta value
+func (d BoltDB) SetMeta(key, value []byte) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbMetaBucket).Put(key, value)
+	})
+}
+
+func (db LevelDB) AddBlacklisted(e BlacklistEntry) error {
+	return db.meta.Put(dbMetaKey(dbBlacklistBucket, e.Key()), e.Bytes(), nil)
+}
+
+func (db LevelDB) BlacklistedEntries() (entries []BlacklistEntry, err error) {
+	iter := db.meta.NewIterator(util.BytesPrefix(dbMetaKey(dbBlacklistBucket, nil)), nil)
+	for iter.Next() {
+		e, err := BlacklistEntryFromBytes(iter.Value())
+		if err != nil {
+			iter.Release()
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	iter.Release()
+	return entries, iter.Error()
+}
+
+func (db LevelDB) RemoveBlacklistedBefore(deadline time.Time) error {
+	prefix := dbMetaKey(dbBlacklistBucket, nil)
+	iter := db.meta.NewIterator(&util.Range{
+		Start: prefix,
+		Limit: dbMetaKey(dbBlacklistBucket, blacklistKeyStart(deadline)),
+	}, nil)
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return db.meta.Write(batch, nil)
+}
+
+func (db LevelDB) GetMeta(key []byte) ([]byte, error) {
+	value, err := db.meta.Get(dbMetaKey(dbMetaBucket, key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (db LevelDB) SetMeta(key, value []byte) error {
+	return db.meta.Put(dbMetaKey(dbMetaBucket, key), value, nil)
+}
+
+// AddQueued saves pending download
+func (d BoltDB) AddQueued(e QueueEntry) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbQueueBucket).Put(e.Key(), e.Bytes())
+	})
+}
+
+// GetQueued loads pending download of file
+func (d BoltDB) GetQueued(f File) (e QueueEntry, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(dbQueueBucket).Get(f.Hash[:])
+		if len(data) == 0 {
+			return ErrQueueNotFound
+		}
+		// data is valid only inside transaction
+		e, err = QueueEntryFromBytes(data)
+		return err
+	})
+	return e, err
+}
+
+// RemoveQueued deletes pending download of file
+func (d BoltDB) RemoveQueued(f File) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbQueueBucket).Delete(f.Hash[:])
+	})
+}
+
+// QueuedEntries returns all pending downloads
+func (d BoltDB) QueuedEntries() (entries []QueueEntry, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbQueueBucket).ForEach(func(k []byte, v []byte) error {
+			e, err := QueueEntryFromBytes(v)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func (db LevelDB) AddQueued(e QueueEntry) error {
+	return db.meta.Put(dbMetaKey(dbQueueBucket, e.Key()), e.Bytes(), nil)
+}
+
+func (db LevelDB) GetQueued(f File) (e QueueEntry, err error) {
+	data, err := db.meta.Get(dbMetaKey(dbQueueBucket, f.Hash[:]), nil)
+	if err == leveldb.ErrNotFound {
+		return e, ErrQueueNotFound
+	}
+	if err != nil {
+		return e, err
+	}
+	return QueueEntryFromBytes(data)
+}
+
+func (db LevelDB) RemoveQueued(f File) error {
+	return db.meta.Delete(dbMetaKey(dbQueueBucket, f.Hash[:]), nil)
+}
+
+func (db LevelDB) QueuedEntries() (entries []QueueEntry, err error) {
+	iter := db.meta.NewIterator(util.BytesPrefix(dbMetaKey(dbQueueBucket, nil)), nil)
+	for iter.Next() {
+		e, err := QueueEntryFromBytes(iter.Value())
+		if err != nil {
+			iter.Release()
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	iter.Release()
+	return entries, iter.Error()
+}
+
+// SetStats saves statistics record
+func (d BoltDB) SetStats(key, value []byte) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbStatsBucket).Put(key, value)
+	})
+}
+
+// RemoveStats deletes statistics record
+func (d BoltDB) RemoveStats(key []byte) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbStatsBucket).Delete(key)
+	})
+}
+
+// StatsRecords returns copy of all statistics records
+func (d BoltDB) StatsRecords() (records map[string][]byte, err error) {
+	records = make(map[string][]byte)
+	err = d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(dbStatsBucket).ForEach(func(k []byte, v []byte) error {
+			records[string(k)] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	return records, err
+}
+
+func (db LevelDB) SetStats(key, value []byte) error {
+	return db.meta.Put(dbMetaKey(dbStatsBucket, key), value, nil)
+}
+
+func (db LevelDB) RemoveStats(key []byte) error {
+	return db.meta.Delete(dbMetaKey(dbStatsBucket, key), nil)
+}
+
+func (db LevelDB) StatsRecords() (map[string][]byte, error) {
+	records := make(map[string][]byte)
+	prefix := dbMetaKey(dbStatsBucket, nil)
+	iter := db.meta.NewIterator(util.BytesPrefix(prefix), nil)
+	for iter.Next() {
+		key := string(iter.Key()[len(prefix):])
+		records[key] = append([]byte(nil), iter.Value()...)
+	}
+	iter.Release()
+	return records, iter.Error()
+}
+
+// dbMetaKey joins bucket name and key, emulating
+// boltdb buckets in flat leveldb key space
+func dbMetaKey(bucket, key []byte) []byte {
+	return bytes.Join([][]byte{bucket, key}, []byte("/"))
+}
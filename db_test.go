@@ -43,6 +43,22 @@ func TestDBCollect(t *testing.T) {
 			files = append(files, f)
 			size += f.Size
 		}
+		Convey("Queue", func() {
+			f := g.NewFake()
+			e := QueueEntry{File: f, URL: "http://host/image.php", Added: time.Unix(0, 100), NextRetry: time.Unix(0, 200)}
+			So(db.AddQueued(e), ShouldBeNil)
+			e.Attempts = 2
+			So(db.AddQueued(e), ShouldBeNil)
+			entries, err := db.QueuedEntries()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+			So(entries[0].Attempts, ShouldEqual, 2)
+			So(entries[0].URL, ShouldEqual, e.URL)
+			So(db.RemoveQueued(f), ShouldBeNil)
+			entries, err = db.QueuedEntries()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 0)
+		})
 		Convey("Insert", func() {
 			So(db.AddBatch(files), ShouldBeNil)
 			Convey("Count", func() {
@@ -81,6 +97,56 @@ func TestDBInit(t *testing.T) {
 			dbInterface := reflect.TypeOf((*DataBase)(nil)).Elem()
 			So(reflect.TypeOf(db).Implements(dbInterface), ShouldBeTrue)
 		})
+		Convey("Meta", func() {
+			value, err := db.GetMeta([]byte("key"))
+			So(err, ShouldBeNil)
+			So(value, ShouldBeNil)
+			So(db.SetMeta([]byte("key"), []byte("value")), ShouldBeNil)
+			value, err = db.GetMeta([]byte("key"))
+			So(err, ShouldBeNil)
+			So(string(value), ShouldEqual, "value")
+		})
+		Convey("Queue", func() {
+			f := g.NewFake()
+			e := QueueEntry{File: f, URL: "http://host/image.php", Added: time.Unix(0, 100), NextRetry: time.Unix(0, 200)}
+			So(db.AddQueued(e), ShouldBeNil)
+			e.Attempts = 2
+			So(db.AddQueued(e), ShouldBeNil)
+			entries, err := db.QueuedEntries()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+			So(entries[0].Attempts, ShouldEqual, 2)
+			So(entries[0].URL, ShouldEqual, e.URL)
+			So(db.RemoveQueued(f), ShouldBeNil)
+			entries, err = db.QueuedEntries()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 0)
+		})
+		Convey("Blacklist retention", func() {
+			old := BlacklistEntry{File: g.NewFake(), Time: time.Unix(100, 0)}
+			recent := BlacklistEntry{File: g.NewFake(), Time: time.Unix(300, 0)}
+			So(db.AddBlacklisted(old), ShouldBeNil)
+			So(db.AddBlacklisted(recent), ShouldBeNil)
+			So(db.RemoveBlacklistedBefore(time.Unix(200, 0)), ShouldBeNil)
+			entries, err := db.BlacklistedEntries()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+			So(entries[0].File.String(), ShouldEqual, recent.File.String())
+		})
+		Convey("Stats", func() {
+			So(db.SetStats([]byte("totals"), []byte("old")), ShouldBeNil)
+			So(db.SetStats([]byte("totals"), []byte("new")), ShouldBeNil)
+			So(db.SetStats([]byte("day"), []byte("value")), ShouldBeNil)
+			records, err := db.StatsRecords()
+			So(err, ShouldBeNil)
+			So(records, ShouldResemble, map[string][]byte{
+				"totals": []byte("new"), "day": []byte("value"),
+			})
+			So(db.RemoveStats([]byte("day")), ShouldBeNil)
+			records, err = db.StatsRecords()
+			So(err, ShouldBeNil)
+			So(records, ShouldHaveLength, 1)
+		})
 		Convey("Insert", func() {
 			rec := g.NewFake()
 			rec.LastUsage -= 20
@@ -135,6 +201,56 @@ func TestLevelDBInit(t *testing.T) {
 			dbInterface := reflect.TypeOf((*DataBase)(nil)).Elem()
 			So(reflect.TypeOf(db).Implements(dbInterface), ShouldBeTrue)
 		})
+		Convey("Meta", func() {
+			value, err := db.GetMeta([]byte("key"))
+			So(err, ShouldBeNil)
+			So(value, ShouldBeNil)
+			So(db.SetMeta([]byte("key"), []byte("value")), ShouldBeNil)
+			value, err = db.GetMeta([]byte("key"))
+			So(err, ShouldBeNil)
+			So(string(value), ShouldEqual, "value")
+		})
+		Convey("Queue", func() {
+			f := g.NewFake()
+			e := QueueEntry{File: f, URL: "http://host/image.php", Added: time.Unix(0, 100), NextRetry: time.Unix(0, 200)}
+			So(db.AddQueued(e), ShouldBeNil)
+			e.Attempts = 2
+			So(db.AddQueued(e), ShouldBeNil)
+			entries, err := db.QueuedEntries()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+			So(entries[0].Attempts, ShouldEqual, 2)
+			So(entries[0].URL, ShouldEqual, e.URL)
+			So(db.RemoveQueued(f), ShouldBeNil)
+			entries, err = db.QueuedEntries()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 0)
+		})
+		Convey("Blacklist retention", func() {
+			old := BlacklistEntry{File: g.NewFake(), Time: time.Unix(100, 0)}
+			recent := BlacklistEntry{File: g.NewFake(), Time: time.Unix(300, 0)}
+			So(db.AddBlacklisted(old), ShouldBeNil)
+			So(db.AddBlacklisted(recent), ShouldBeNil)
+			So(db.RemoveBlacklistedBefore(time.Unix(200, 0)), ShouldBeNil)
+			entries, err := db.BlacklistedEntries()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+			So(entries[0].File.String(), ShouldEqual, recent.File.String())
+		})
+		Convey("Stats", func() {
+			So(db.SetStats([]byte("totals"), []byte("old")), ShouldBeNil)
+			So(db.SetStats([]byte("totals"), []byte("new")), ShouldBeNil)
+			So(db.SetStats([]byte("day"), []byte("value")), ShouldBeNil)
+			records, err := db.StatsRecords()
+			So(err, ShouldBeNil)
+			So(records, ShouldResemble, map[string][]byte{
+				"totals": []byte("new"), "day": []byte("value"),
+			})
+			So(db.RemoveStats([]byte("day")), ShouldBeNil)
+			records, err = db.StatsRecords()
+			So(err, ShouldBeNil)
+			So(records, ShouldHaveLength, 1)
+		})
 		Convey("Insert", func() {
 			rec := g.NewFake()
 			rec.LastUsage -= 20
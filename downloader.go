@@ -0,0 +1,137 @@
+package hath
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// downloadRetryBackoff is base delay between download attempts
+	downloadRetryBackoff    = time.Second
+	downloadMaxRetryBackoff = time.Second * 30
+)
+
+// downloadJob is request to download file from url into cache
+type downloadJob struct {
+	ctx    context.Context
+	f      File
+	u      *url.URL
+	result chan<- downloadResult
+}
+
+// downloadResult is outcome of download job
+type downloadResult struct {
+	f   File
+	u   *url.URL
+	err error
+}
+
+// downloadWorker processes download jobs until server is stopped
+func (s *DefaultServer) downloadWorker() {
+	defer s.wg.Done()
+	for {
+		select {
+		case j := <-s.downloadJobs:
+			j.result <- downloadResult{f: j.f, u: j.u, err: s.download(j.ctx, j.f, j.u)}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// download adds file from url to cache, retrying failed attempts;
+// every attempt is limited by DownloadTimeout
+func (s *DefaultServer) download(ctx context.Context, f File, u *url.URL) (err error) {
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, s.cfg.DownloadTimeout)
+		err = s.addFromURL(attemptCtx, f, u)
+		cancel()
+		if err == nil || ctx.Err() != nil || attempt >= s.cfg.DownloadRetries {
+			return err
+		}
+		log.Println("server:", "download of", f, "failed, retrying:", err)
+		select {
+		case <-time.After(backoff(attempt, downloadRetryBackoff, downloadMaxRetryBackoff)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// commandDownload process request from server to download a list of files
+// and store them in database and cache; files are downloaded by worker
+// pool and status of every file is sent as soon as it is completed;
+// failed downloads are saved to download queue
+func (s *DefaultServer) commandDownload(c *gin.Context, args Args) {
+	ctx := c.Request.Context()
+	writeStatus := func(fileID, status string) {
+		fmt.Fprintf(c.Writer, "%s:%s\n", fileID, status)
+		c.Writer.Flush()
+	}
+
+	var jobs []downloadJob
+	results := make(chan downloadResult, len(args))
+	for fileInfo, key := range args {
+		// host can contain port, so splitting only by first delimiter
+		elems := strings.SplitN(fileInfo, fileInfoDelimiter, 2)
+		if len(elems) != 2 {
+			log.Println("warning:", "got bad file info string from server:", fileInfo)
+			continue
+		}
+		fileID := elems[0]
+		host := elems[1]
+
+		// parsing and validating fileID
+		f, err := FileFromID(fileID)
+		if err != nil {
+			writeStatus(fileID, downloadInvalid)
+			continue
+		}
+
+		// generating url
+		u := new(url.URL)
+		u.Host = host
+		u.Scheme = s.api.DownloadScheme()
+		u.Path = downloadPath
+		q := make(url.Values)
+		q.Add(argDownloadFileID, fileID)
+		q.Add(argDownloadKey, key)
+		u.RawQuery = q.Encode()
+
+		jobs = append(jobs, downloadJob{ctx: ctx, f: f, u: u, result: results})
+	}
+
+	// submitting jobs while receiving results
+	go func() {
+		for i, j := range jobs {
+			select {
+			case s.downloadJobs <- j:
+				continue
+			case <-ctx.Done():
+			case <-s.stop:
+			}
+			for _, j := range jobs[i:] {
+				results <- downloadResult{f: j.f, u: j.u, err: ErrDownloadFailed}
+			}
+			return
+		}
+	}()
+	for range jobs {
+		r := <-results
+		if r.err != nil {
+			// failed download is retried later, so
+			// it is not lost if server is stopping
+			s.enqueue(r.f, r.u, r.err)
+			s.emit(Event{Type: EventError, File: r.f, Route: "servercmd", Error: r.err.Error()})
+			writeStatus(r.f.String(), downloadError)
+			continue
+		}
+		writeStatus(r.f.String(), downloadSuccess)
+	}
+}
@@ -0,0 +1,104 @@
+package hath
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// command sends signed server command and returns response lines
+func (s *proxyServer) command(command, kwds string) []string {
+	timestamp := sInt64(s.DefaultServer.api.Now().Unix())
+	key := getSHA1(cmdKeyDelimiter, []string{
+		cmdKeyStart, command, kwds, sInt64(s.cfg.ClientID), timestamp, s.cfg.Key,
+	})
+	u := fmt.Sprintf("%s/servercmd/%s/%s/%s/%s", s.url, command, url.PathEscape(kwds), timestamp, key)
+	res, err := http.Get(u)
+	So(err, ShouldBeNil)
+	defer res.Body.Close()
+	So(res.StatusCode, ShouldEqual, http.StatusOK)
+	body, err := ioutil.ReadAll(res.Body)
+	So(err, ShouldBeNil)
+	return strings.Split(strings.TrimSpace(string(body)), "\n")
+}
+
+func TestCommandDownload(t *testing.T) {
+	Convey("Cache files", t, func() {
+		var (
+			files    []File
+			contents = make(map[string][]byte)
+		)
+		for i := 0; i < 6; i++ {
+			f, data := randomFile(1024)
+			files = append(files, f)
+			contents[f.String()] = data
+		}
+		flaky := files[0]
+
+		var (
+			mu       sync.Mutex
+			requests = make(map[string]int)
+			active   int32
+			peak     int32
+		)
+		server, cleanup := newProxyServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.URL.Query().Get(argDownloadFileID)
+			mu.Lock()
+			requests[id]++
+			count := requests[id]
+			mu.Unlock()
+			n := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond * 20)
+			if id == flaky.String() && count == 1 {
+				http.Error(w, "try again", http.StatusInternalServerError)
+				return
+			}
+			data, ok := contents[id]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		}), func(cfg *ServerConfig) {
+			cfg.DownloadWorkers = 2
+			cfg.Settings.RPCServers = []net.IP{net.ParseIP("127.0.0.1")}
+		})
+		defer cleanup()
+
+		var args []string
+		for _, f := range files {
+			args = append(args, fmt.Sprintf("%s:%s=key", f, server.upstream))
+		}
+		args = append(args, "bad:"+server.upstream+"=key")
+		statuses := make(map[string]string)
+		for _, line := range server.command("cache_files", strings.Join(args, ";")) {
+			elems := strings.SplitN(line, ":", 2)
+			So(elems, ShouldHaveLength, 2)
+			statuses[elems[0]] = elems[1]
+		}
+		So(statuses, ShouldHaveLength, len(files)+1)
+		So(statuses["bad"], ShouldEqual, downloadInvalid)
+		for _, f := range files {
+			So(statuses[f.String()], ShouldEqual, downloadSuccess)
+			So(server.db.Exists(f), ShouldBeTrue)
+		}
+		So(requests[flaky.String()], ShouldEqual, 2)
+		So(atomic.LoadInt32(&peak), ShouldEqual, 2)
+	})
+}
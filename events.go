@@ -0,0 +1,126 @@
+package hath
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// eventBufferSize is size of buffer of subscriber channel
+	eventBufferSize = 128
+)
+
+// subscriber is receiver of events of selected types
+type subscriber struct {
+	events chan Event
+	// types is set of accepted types, all types are accepted if empty
+	types map[EventType]bool
+}
+
+// accepts returns true if subscriber receives events of type t
+func (s subscriber) accepts(t EventType) bool {
+	return len(s.types) == 0 || s.types[t]
+}
+
+// eventBus delivers events to subscribers without blocking publisher,
+// events are dropped for subscribers with full buffer
+type eventBus struct {
+	dropped     uint64 // atomic
+	mu          sync.RWMutex
+	subscribers map[<-chan Event]subscriber
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[<-chan Event]subscriber)}
+}
+
+func (b *eventBus) subscribe(types ...EventType) <-chan Event {
+	s := subscriber{events: make(chan Event, eventBufferSize)}
+	if len(types) != 0 {
+		s.types = make(map[EventType]bool)
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+	b.mu.Lock()
+	b.subscribers[s.events] = s
+	b.mu.Unlock()
+	return s.events
+}
+
+func (b *eventBus) unsubscribe(events <-chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.subscribers[events]
+	if !ok {
+		return
+	}
+	delete(b.subscribers, events)
+	close(s.events)
+}
+
+func (b *eventBus) publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subscribers {
+		if !s.accepts(e.Type) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			atomic.AddUint64(&b.dropped, 1)
+		}
+	}
+}
+
+// Subscribe returns channel that receives events of provided types
+// or all events if no types are provided; channel is buffered and
+// events are dropped if subscriber does not keep up with them
+func (s *DefaultServer) Subscribe(types ...EventType) <-chan Event {
+	return s.events.subscribe(types...)
+}
+
+// Unsubscribe stops delivery of events to channel and closes it
+func (s *DefaultServer) Unsubscribe(events <-chan Event) {
+	s.events.unsubscribe(events)
+}
+
+// EventsDropped returns count of events that were not
+// delivered to subscribers because of full buffer
+func (s *DefaultServer) EventsDropped() uint64 {
+	return atomic.LoadUint64(&s.events.dropped)
+}
+
+// emit updates statistics with event and publishes it to subscribers
+func (s *DefaultServer) emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	s.stats.process(e, e.Time)
+	s.events.publish(e)
+}
+
+// emitRequest emits event of request with its remote ip,
+// route, count of sent bytes and duration since start
+func (s *DefaultServer) emitRequest(c *gin.Context, e Event, start time.Time) {
+	e.IP, _ = FromRequest(c.Request)
+	e.Route = metricRoute(c.Request.URL.Path)
+	e.Duration = time.Since(start)
+	if n := c.Writer.Size(); n > 0 {
+		e.Bytes = int64(n)
+	}
+	s.emit(e)
+}
+
+// emitRPC emits event of completed rpc call
+func (s *DefaultServer) emitRPC(action string, duration time.Duration, err error) {
+	e := Event{Type: EventRPC, Action: action, Duration: duration}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	s.emit(e)
+}
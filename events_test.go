@@ -0,0 +1,104 @@
+package hath
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// nextEvent returns next event from channel or fails after timeout
+func nextEvent(events <-chan Event) Event {
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second * 2):
+		So("timeout", ShouldEqual, "event")
+		return Event{}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	Convey("Events", t, func() {
+		Convey("Bus", func() {
+			b := newEventBus()
+			all := b.subscribe()
+			removed := b.subscribe(EventRemoved, EventEvicted)
+			b.publish(Event{Type: EventSent})
+			b.publish(Event{Type: EventEvicted})
+			So((<-all).Type, ShouldEqual, EventSent)
+			So((<-all).Type, ShouldEqual, EventEvicted)
+			So((<-removed).Type, ShouldEqual, EventEvicted)
+			So(len(removed), ShouldEqual, 0)
+
+			// publishing does not block on full subscriber
+			for i := 0; i < eventBufferSize+10; i++ {
+				b.publish(Event{Type: EventSent})
+			}
+			So(len(all), ShouldEqual, eventBufferSize)
+			So(b.dropped, ShouldEqual, 10)
+
+			b.unsubscribe(all)
+			b.unsubscribe(all)
+			for range all {
+			}
+			b.publish(Event{Type: EventRemoved})
+			So((<-removed).Type, ShouldEqual, EventRemoved)
+		})
+		Convey("Server", func() {
+			f, data := randomFile(1024)
+			server, cleanup := newProxyServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(data)
+			}))
+			defer cleanup()
+			files := server.Subscribe(EventSent, EventDownloaded, EventAdded)
+			rpc := server.Subscribe(EventRPC)
+			defer server.Unsubscribe(files)
+			defer server.Unsubscribe(rpc)
+
+			res, err := http.Get(server.fileURL(f))
+			So(err, ShouldBeNil)
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			server.waitDownloads()
+
+			received := make(map[EventType]Event)
+			for i := 0; i < 3; i++ {
+				e := nextEvent(files)
+				So(e.File.String(), ShouldEqual, f.String())
+				So(e.Time.IsZero(), ShouldBeFalse)
+				received[e.Type] = e
+			}
+			sent := received[EventSent]
+			So(sent.IP.String(), ShouldEqual, "127.0.0.1")
+			So(sent.Route, ShouldEqual, "p")
+			So(sent.Bytes, ShouldEqual, 1024)
+			So(sent.Duration, ShouldBeGreaterThan, 0)
+			So(received[EventDownloaded].Bytes, ShouldEqual, 1024)
+			So(received[EventAdded].Bytes, ShouldEqual, 1024)
+
+			e := nextEvent(rpc)
+			So(e.Action, ShouldEqual, actionFileAdd)
+			So(e.Error, ShouldBeEmpty)
+			So(server.Stats().FilesTotal, ShouldEqual, 1)
+		})
+		Convey("Bad keystamp", func() {
+			f, _ := randomFile(1024)
+			server, cleanup := newProxyServer(http.NotFoundHandler())
+			defer cleanup()
+			errs := server.Subscribe(EventError)
+			defer server.Unsubscribe(errs)
+			u := fmt.Sprintf("%s/h/%s/keystamp=%d-bad/test.jpg", server.url, f, time.Now().Unix())
+			res, err := http.Get(u)
+			So(err, ShouldBeNil)
+			res.Body.Close()
+			So(res.StatusCode, ShouldEqual, http.StatusForbidden)
+			e := nextEvent(errs)
+			So(e.Route, ShouldEqual, "h")
+			So(e.Duration, ShouldBeGreaterThan, 0)
+		})
+	})
+}
@@ -0,0 +1,155 @@
+package hath
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRPCUnavailable is returned when circuits of all rpc servers are open
+	ErrRPCUnavailable = errors.New("All rpc servers are unavailable")
+)
+
+// rpcEndpoint is rpc server host with state of circuit breaker
+type rpcEndpoint struct {
+	host      string
+	failures  int
+	openUntil time.Time
+}
+
+// open returns true if requests to endpoint are not allowed
+func (e *rpcEndpoint) open(now time.Time) bool {
+	return now.Before(e.openUntil)
+}
+
+// rpcPool is pool of rpc servers with failover, first
+// endpoint is configured rpc host and others are fallbacks
+type rpcPool struct {
+	mu        sync.Mutex
+	endpoints []*rpcEndpoint
+	threshold int
+	cooldown  time.Duration
+}
+
+func newRPCPool(host string, threshold int, cooldown time.Duration) *rpcPool {
+	return &rpcPool{
+		endpoints: []*rpcEndpoint{{host: host}},
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// setServers replaces fallback endpoints with rpc servers,
+// port of primary host is used for them if set
+func (p *rpcPool) setServers(ips []net.IP) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	primary := p.endpoints[0]
+	_, port, err := net.SplitHostPort(primary.host)
+	if err != nil {
+		port = ""
+	}
+	old := make(map[string]*rpcEndpoint)
+	for _, e := range p.endpoints[1:] {
+		old[e.host] = e
+	}
+	endpoints := []*rpcEndpoint{primary}
+	for _, ip := range ips {
+		host := ip.String()
+		if len(port) != 0 {
+			host = net.JoinHostPort(host, port)
+		} else if ip.To4() == nil {
+			host = "[" + host + "]"
+		}
+		if host == primary.host {
+			continue
+		}
+		e, ok := old[host]
+		if !ok {
+			e = &rpcEndpoint{host: host}
+		}
+		endpoints = append(endpoints, e)
+	}
+	p.endpoints = endpoints
+}
+
+// hosts returns hosts of all endpoints
+func (p *rpcPool) hosts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hosts := make([]string, len(p.endpoints))
+	for i, e := range p.endpoints {
+		hosts[i] = e.host
+	}
+	return hosts
+}
+
+// pick returns first endpoint with closed circuit, skipping
+// previously failed host if other is available
+func (p *rpcPool) pick(now time.Time, failed string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var candidate *rpcEndpoint
+	for _, e := range p.endpoints {
+		if e.open(now) {
+			continue
+		}
+		if candidate == nil || (candidate.host == failed && e.host != failed) {
+			candidate = e
+		}
+		if candidate.host != failed {
+			break
+		}
+	}
+	if candidate == nil {
+		return "", ErrRPCUnavailable
+	}
+	if candidate.failures >= p.threshold {
+		// half-open circuit, allowing single trial request
+		candidate.openUntil = now.Add(p.cooldown)
+	}
+	return candidate.host, nil
+}
+
+// success closes circuit of host
+func (p *rpcPool) success(host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.endpoints {
+		if e.host == host {
+			e.failures = 0
+			e.openUntil = time.Time{}
+		}
+	}
+}
+
+// failure registers failed request and opens circuit of
+// host after threshold of consecutive failures
+func (p *rpcPool) failure(host string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.endpoints {
+		if e.host != host {
+			continue
+		}
+		e.failures++
+		if e.failures >= p.threshold {
+			log.Println("client:", "circuit of rpc server", host, "is open for", p.cooldown)
+			e.openUntil = now.Add(p.cooldown)
+		}
+	}
+}
+
+// backoff returns exponential delay with jitter before retry attempt
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	d := base << uint(attempt)
+	if d > max || d <= 0 {
+		d = max
+	}
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
@@ -0,0 +1,149 @@
+package hath
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// hostClient fails requests to hosts from failing set
+type hostClient struct {
+	mu       sync.Mutex
+	failing  map[string]bool
+	requests []string
+	hosts    []string
+}
+
+func (h *hostClient) Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest(httpGET, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return h.Do(req)
+}
+
+func (h *hostClient) Do(req *http.Request) (*http.Response, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests = append(h.requests, req.URL.Host)
+	h.hosts = append(h.hosts, req.Host)
+	if h.failing[req.URL.Host] {
+		return nil, errors.New("connection refused")
+	}
+	r := new(http.Response)
+	r.StatusCode = http.StatusOK
+	r.Body = ioutil.NopCloser(bytes.NewBufferString("OK"))
+	return r, nil
+}
+
+func TestRPCPool(t *testing.T) {
+	Convey("RPC pool", t, func() {
+		now := time.Now()
+		p := newRPCPool("rpc.local:8080", 2, time.Minute)
+		p.setServers([]net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")})
+		So(p.hosts(), ShouldResemble, []string{"rpc.local:8080", "192.0.2.1:8080", "[2001:db8::1]:8080"})
+		host, err := p.pick(now, "")
+		So(err, ShouldBeNil)
+		So(host, ShouldEqual, "rpc.local:8080")
+		Convey("Skip failed", func() {
+			host, err := p.pick(now, "rpc.local:8080")
+			So(err, ShouldBeNil)
+			So(host, ShouldEqual, "192.0.2.1:8080")
+		})
+		Convey("Circuit", func() {
+			p.failure("rpc.local:8080", now)
+			host, _ := p.pick(now, "")
+			So(host, ShouldEqual, "rpc.local:8080")
+			p.failure("rpc.local:8080", now)
+			host, _ = p.pick(now, "")
+			So(host, ShouldEqual, "192.0.2.1:8080")
+			Convey("Half open", func() {
+				later := now.Add(time.Minute * 2)
+				host, _ := p.pick(later, "")
+				So(host, ShouldEqual, "rpc.local:8080")
+				// only single trial request is allowed
+				host, _ = p.pick(later, "")
+				So(host, ShouldEqual, "192.0.2.1:8080")
+				p.success("rpc.local:8080")
+				host, _ = p.pick(later, "")
+				So(host, ShouldEqual, "rpc.local:8080")
+			})
+			Convey("All open", func() {
+				for _, h := range p.hosts() {
+					p.failure(h, now)
+					p.failure(h, now)
+				}
+				_, err := p.pick(now, "")
+				So(err, ShouldEqual, ErrRPCUnavailable)
+			})
+			Convey("State is kept on update", func() {
+				p.failure("192.0.2.1:8080", now)
+				p.failure("192.0.2.1:8080", now)
+				p.setServers([]net.IP{net.ParseIP("192.0.2.1")})
+				_, err := p.pick(now, "")
+				So(err, ShouldEqual, ErrRPCUnavailable)
+			})
+		})
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	Convey("Backoff", t, func() {
+		base := time.Millisecond * 100
+		max := time.Second
+		for attempt := 0; attempt < 10; attempt++ {
+			d := backoff(attempt, base, max)
+			expected := base << uint(attempt)
+			if expected > max {
+				expected = max
+			}
+			So(d, ShouldBeGreaterThanOrEqualTo, expected/2)
+			So(d, ShouldBeLessThanOrEqualTo, expected)
+		}
+	})
+}
+
+func TestClientFailover(t *testing.T) {
+	Convey("Client failover", t, func() {
+		c := NewClient(ClientConfig{
+			Host:             "rpc.local",
+			RetryBackoff:     time.Millisecond,
+			MaxRetryBackoff:  time.Millisecond,
+			CircuitThreshold: 2,
+		})
+		h := &hostClient{failing: map[string]bool{"rpc.local": true}}
+		c.httpClient = h
+		c.pool.setServers([]net.IP{net.ParseIP("192.0.2.1")})
+		So(c.StillAlive(), ShouldBeNil)
+		So(h.requests, ShouldResemble, []string{"rpc.local", "192.0.2.1"})
+		Convey("Host header is kept", func() {
+			So(h.hosts, ShouldResemble, []string{"rpc.local", "rpc.local"})
+		})
+		Convey("Circuit is open", func() {
+			h.requests = nil
+			So(c.StillAlive(), ShouldBeNil)
+			So(c.StillAlive(), ShouldBeNil)
+			So(h.requests, ShouldResemble, []string{"rpc.local", "192.0.2.1", "192.0.2.1"})
+		})
+		Convey("All failing", func() {
+			h.failing["192.0.2.1"] = true
+			h.requests = nil
+			So(c.StillAlive(), ShouldNotBeNil)
+			So(len(h.requests), ShouldBeLessThanOrEqualTo, c.cfg.MaxRetries+1)
+		})
+		Convey("Retries disabled", func() {
+			c := NewClient(ClientConfig{Host: "rpc.local", MaxRetries: -1})
+			h := &hostClient{failing: map[string]bool{"rpc.local": true}}
+			c.httpClient = h
+			So(c.StillAlive(), ShouldNotBeNil)
+			So(h.requests, ShouldResemble, []string{"rpc.local"})
+		})
+	})
+}
@@ -93,18 +93,28 @@ func (s StaticRanges) String() string {
 }
 
 func (f FileType) String() string {
-	if f == JPG {
+	switch f {
+	case JPG:
 		return "jpg"
-	}
-	if f == PNG {
+	case PNG:
 		return "png"
-	}
-	if f == GIF {
+	case GIF:
 		return "gif"
+	case WBP:
+		return "wbp"
+	case WBM:
+		return "wbm"
+	case AVF:
+		return "avf"
+	case JXL:
+		return "jxl"
+	default:
+		return "tmp"
 	}
-	return "tmp"
 }
 
+// values of FileType are stored in database and
+// should never be changed, new types are added to the end
 const (
 	// JPG image
 	JPG FileType = iota
@@ -114,6 +124,14 @@ const (
 	GIF
 	// UnknownImage is not supported format
 	UnknownImage
+	// WBP is WebP image
+	WBP
+	// WBM is WebM video
+	WBM
+	// AVF is AVIF image
+	AVF
+	// JXL is JPEG XL image
+	JXL
 )
 
 var (
@@ -122,6 +140,10 @@ var (
 		JPG:          "image/jpeg",
 		PNG:          "image/png",
 		GIF:          "image/gif",
+		WBP:          "image/webp",
+		WBM:          "video/webm",
+		AVF:          "image/avif",
+		JXL:          "image/jxl",
 		UnknownImage: "application/octet-stream",
 	}
 )
@@ -142,6 +164,14 @@ func ParseFileType(t string) FileType {
 		return PNG
 	case "gif":
 		return GIF
+	case "wbp", "webp":
+		return WBP
+	case "wbm", "webm":
+		return WBM
+	case "avf", "avif":
+		return AVF
+	case "jxl":
+		return JXL
 	default:
 		return UnknownImage
 	}
@@ -162,18 +192,21 @@ type File struct {
 	LastUsage int64 `json:"last_usage"` // 8 byte (can be optimized)
 }
 
-// ContentType of image
+// ContentType of image, based on declared type
 func (f File) ContentType() string {
-	switch f.Type {
-	case JPG:
-		return "image/jpeg"
-	case PNG:
-		return "image/png"
-	case GIF:
-		return "image/gif"
-	default:
-		return "application/octet-stream"
+	if t, ok := ContentTypes[f.Type]; ok {
+		return t
+	}
+	return ContentTypes[UnknownImage]
+}
+
+// SniffContentType returns content type of image detected
+// from head of its content with fallback to declared type
+func (f File) SniffContentType(head []byte) string {
+	if t := SniffFileType(head); t != UnknownImage {
+		return ContentTypes[t]
 	}
+	return f.ContentType()
 }
 
 // Range returns static range of file
@@ -209,6 +209,26 @@ func TestFileID(t *testing.T) {
 			So(parsed.Width, ShouldEqual, f.Width)
 			So(parsed.Height, ShouldEqual, f.Height)
 			So(parsed.Type, ShouldEqual, f.Type)
+			Convey("New types", func() {
+				for _, t := range []FileType{WBP, WBM, AVF, JXL} {
+					nf := f
+					nf.Type = t
+					parsed, err := FileFromID(nf.String())
+					So(err, ShouldBeNil)
+					So(parsed.Type, ShouldEqual, t)
+					So(parsed.String(), ShouldEqual, nf.String())
+					So(parsed.ContentType(), ShouldEqual, ContentTypes[t])
+					deserialized, err := FileFromBytes(nf.Bytes())
+					So(err, ShouldBeNil)
+					So(deserialized.Type, ShouldEqual, t)
+				}
+			})
+			Convey("Type byte compatibility", func() {
+				So(byte(JPG), ShouldEqual, 0)
+				So(byte(PNG), ShouldEqual, 1)
+				So(byte(GIF), ShouldEqual, 2)
+				So(byte(UnknownImage), ShouldEqual, 3)
+			})
 			Convey("Error handling", func() {
 				examples := []string{
 					"070b45ae488fb1967aaf618561a7d6ba4d28a1c9-?-1920-1080-png",
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ernado/hath/hathsim"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	cfg        hathsim.Config
+	faulty     int
+	fault      hathsim.Fault
+	jsonOutput bool
+	verbose    bool
+)
+
+func init() {
+	flag.IntVar(&cfg.Nodes, "nodes", 3, "count of nodes")
+	flag.IntVar(&cfg.Files, "files", 100, "count of files on rpc servers")
+	flag.Int64Var(&cfg.FileSize, "size", 16*1024, "size of file in bytes")
+	flag.IntVar(&cfg.CachedFiles, "cached", 0, "files cached on every node (default files/2)")
+	flag.IntVar(&cfg.Requests, "requests", 1000, "count of synthetic requests")
+	flag.IntVar(&cfg.Concurrency, "concurrency", 8, "count of concurrent requests")
+	flag.Float64Var(&cfg.ZipfS, "zipf", 1.1, "exponent of file popularity distribution")
+	flag.IntVar(&cfg.ProxyTests, "proxy-tests", 0, "count of proxy_test commands (default nodes*2)")
+	flag.IntVar(&cfg.ThreadedTests, "threaded-tests", 0, "count of threaded_proxy_test commands (default nodes)")
+	flag.Int64Var(&cfg.ThreadedSize, "threaded-size", 64*1024, "size of threaded_proxy_test download")
+	flag.IntVar(&cfg.ThreadedCount, "threaded-count", 4, "downloads in threaded_proxy_test")
+	flag.DurationVar(&cfg.Timeout, "timeout", time.Second*10, "timeout of single request")
+	flag.Int64Var(&cfg.Seed, "seed", 0, "random seed (default current time)")
+	flag.StringVar(&cfg.Dir, "dir", "", "directory for node files (default temporary)")
+	flag.IntVar(&faulty, "faulty", 0, "count of nodes with injected faults")
+	flag.DurationVar(&fault.Latency, "fault-latency", 0, "latency of faulty node responses")
+	flag.Float64Var(&fault.DropRate, "fault-drop", 0, "probability of dropped connection to faulty node")
+	flag.Float64Var(&fault.CorruptRate, "fault-corrupt", 0, "probability of corrupted response of faulty node")
+	flag.BoolVar(&jsonOutput, "json", false, "print report in json")
+	flag.BoolVar(&verbose, "v", false, "print logs of nodes")
+}
+
+// fatal prints error even if logs are disabled and exits
+func fatal(v ...interface{}) {
+	log.SetOutput(os.Stderr)
+	log.Fatalln(append([]interface{}{"sim:"}, v...)...)
+}
+
+func main() {
+	flag.Parse()
+	if !verbose {
+		log.SetOutput(ioutil.Discard)
+		gin.SetMode(gin.ReleaseMode)
+		gin.DefaultWriter = ioutil.Discard
+	}
+	cfg.Faults = make(map[int]hathsim.Fault)
+	for i := 0; i < faulty; i++ {
+		cfg.Faults[i] = fault
+	}
+	network, err := hathsim.New(cfg)
+	if err != nil {
+		fatal("failed to start network:", err)
+	}
+	report, err := network.Run()
+	if closeErr := network.Close(); closeErr != nil {
+		log.Println("sim:", "failed to stop network:", closeErr)
+	}
+	if err != nil {
+		fatal("simulation failed:", err)
+	}
+	if jsonOutput {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		e.Encode(report)
+		return
+	}
+	report.Print(os.Stdout)
+}
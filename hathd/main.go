@@ -6,8 +6,10 @@ import (
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"net/url"
 	"os"
 	"path"
+	"time"
 
 	"github.com/ernado/hath"
 
@@ -25,6 +27,22 @@ var (
 	credentialsPath string
 	debug           bool
 	scan            bool
+	quarantine      bool
+	checkContent    bool
+	connectionLimit int64
+	downloadLimit   int64
+	downloadWorkers int
+	rateLimit       hath.RateLimitConfig
+	overload        hath.OverloadConfig
+	prefetch        hath.PrefetchConfig
+	suspendFor      time.Duration
+	useTLS          bool
+	metricsToken    string
+	rpcHost         string
+	rpcScheme       string
+	rpcPath         string
+	rpcURL          string
+	downloadScheme  string
 )
 
 func createDirIfNotExists() error {
@@ -42,6 +60,30 @@ func init() {
 	flag.Int64Var(&clientID, "client-id", 0, "Hentai@Home client id")
 	flag.BoolVar(&debug, "debug", false, "enable debug")
 	flag.BoolVar(&scan, "scan", false, "scan files from cache and add them to database")
+	flag.BoolVar(&quarantine, "quarantine", true, "keep corrupt or rejected files in quarantine")
+	flag.BoolVar(&checkContent, "check-content", false, "check type and resolution of downloaded images")
+	flag.Int64Var(&connectionLimit, "connection-limit", 0, "maximum bytes per second for single connection")
+	flag.Int64Var(&downloadLimit, "download-limit", 0, "maximum bytes per second for all downloads to cache")
+	flag.IntVar(&downloadWorkers, "download-workers", 0, "count of concurrent cache_files downloads")
+	flag.IntVar(&rateLimit.MaxConnectionsPerIP, "ip-connections", 0, "maximum concurrent connections from single ip")
+	flag.IntVar(&rateLimit.MaxConnectionsPerSubnet, "subnet-connections", 0, "maximum concurrent connections from single /24 or /64 subnet")
+	flag.Float64Var(&rateLimit.RequestsPerIP, "ip-rate", 0, "maximum requests per second from single ip")
+	flag.Float64Var(&rateLimit.RequestsPerSubnet, "subnet-rate", 0, "maximum requests per second from single /24 or /64 subnet")
+	flag.BoolVar(&rateLimit.ExemptRPCServers, "rate-exempt-rpc", true, "do not limit requests from rpc servers")
+	flag.BoolVar(&rateLimit.ExemptLocalNetworks, "rate-exempt-local", false, "do not limit requests from local networks")
+	flag.Int64Var(&overload.MaxConnections, "overload-connections", 0, "count of active connections after which server is overloaded")
+	flag.DurationVar(&overload.MaxLatency, "overload-latency", 0, "average response time after which server is overloaded")
+	flag.BoolVar(&prefetch.Enabled, "prefetch", false, "prefetch following pages of requested galleries")
+	flag.IntVar(&prefetch.Pages, "prefetch-pages", 0, "count of following gallery pages to prefetch")
+	flag.Float64Var(&prefetch.BandwidthShare, "prefetch-share", 0, "part of download bandwidth available for prefetching")
+	flag.StringVar(&metricsToken, "metrics-token", "", "token for access to /metrics from non-local networks")
+	flag.BoolVar(&useTLS, "tls", false, "serve https with certificate issued by rpc server")
+	flag.DurationVar(&suspendFor, "suspend-duration", 0, "resume automatically after suspend by signal, if set")
+	flag.StringVar(&rpcHost, "rpc-host", "", "rpc server host")
+	flag.StringVar(&rpcScheme, "rpc-scheme", "", "rpc server scheme")
+	flag.StringVar(&rpcPath, "rpc-path", "", "rpc api path")
+	flag.StringVar(&rpcURL, "rpc-url", "", "rpc api base url, overrides rpc host, scheme and path")
+	flag.StringVar(&downloadScheme, "download-scheme", "", "scheme of file downloads")
 	flag.StringVar(&clientKey, "client-key", "", "Hentai@Home client key")
 	flag.StringVar(&dir, "dir", "hath", "working directory")
 	flag.StringVar(&credentialsPath, "cfg", "cfg.toml", "Path to credentials")
@@ -77,8 +119,34 @@ func main() {
 		log.Println("hath: credentials loaded from", credentialsPath)
 	}
 	cfg.Credentials = credentials
+	clientCfg := hath.ClientConfig{
+		Credentials:    credentials,
+		Host:           rpcHost,
+		Scheme:         rpcScheme,
+		Path:           rpcPath,
+		DownloadScheme: downloadScheme,
+		Debug:          debug,
+	}
+	if len(rpcURL) != 0 {
+		if clientCfg.BaseURL, err = url.Parse(rpcURL); err != nil {
+			log.Fatal("hath: bad rpc url", err)
+		}
+	}
+	cfg.Client = hath.NewClient(clientCfg)
 	cfg.Frontend = frontend
 	cfg.DataBase = db
+	if quarantine {
+		cfg.QuarantineDir = path.Join(dir, "quarantine")
+	}
+	cfg.CheckContent = checkContent
+	cfg.MaxConnectionBytesPerSecond = connectionLimit
+	cfg.MaxDownloadBytesPerSecond = downloadLimit
+	cfg.DownloadWorkers = downloadWorkers
+	cfg.RateLimit = rateLimit
+	cfg.Overload = overload
+	cfg.Prefetch = prefetch
+	cfg.TLS = useTLS
+	cfg.MetricsToken = metricsToken
 	if debug {
 		cfg.DontCheckTimestamps = true
 		cfg.DontCheckSHA1 = true
@@ -109,11 +177,15 @@ func main() {
 	closer.Bind(func() {
 		s.Close()
 	})
+	handleSignals(s)
 
 	// starting server
 	if err := s.Start(); err != nil {
 		log.Fatal(err)
 	}
-	log.Fatal(s.Listen())
+	if err := s.Listen(); err != nil {
+		log.Fatal(err)
+	}
+	// server is closed, waiting for closer to exit
 	closer.Hold()
 }
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ernado/hath"
+)
+
+// handleSignals suspends server on SIGUSR1 and resumes on SIGUSR2
+func handleSignals(s *hath.DefaultServer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			var err error
+			switch sig {
+			case syscall.SIGUSR1:
+				log.Println("hath:", "got", sig, "suspending")
+				err = s.Suspend(suspendFor)
+			case syscall.SIGUSR2:
+				log.Println("hath:", "got", sig, "resuming")
+				err = s.Resume()
+			}
+			if err != nil {
+				log.Println("hath:", "failed to handle", sig, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,8 @@
+package main
+
+import (
+	"github.com/ernado/hath"
+)
+
+// handleSignals is not supported on windows, use admin api instead
+func handleSignals(s *hath.DefaultServer) {}
@@ -0,0 +1,108 @@
+package hathsim
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault is set of failures injected into responses of node to peers
+type Fault struct {
+	// Latency is delay before every response
+	Latency time.Duration
+	// DropRate is probability of closing connection without response
+	DropRate float64
+	// CorruptRate is probability of corrupting response body,
+	// which leads to bad hash on receiving side
+	CorruptRate float64
+}
+
+// IsZero returns true if no failures are injected
+func (f Fault) IsZero() bool {
+	return f.Latency == 0 && f.DropRate == 0 && f.CorruptRate == 0
+}
+
+// Handler wraps h with fault injection; server commands
+// from rpc server are passed as is
+func (f Fault) Handler(h http.Handler, rnd *lockedRand) http.Handler {
+	if f.IsZero() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/servercmd/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if f.Latency > 0 {
+			time.Sleep(f.Latency)
+		}
+		if rnd.Float64() < f.DropRate {
+			drop(w)
+			return
+		}
+		if rnd.Float64() < f.CorruptRate {
+			w = &corruptWriter{ResponseWriter: w}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// drop closes underlying connection without writing response
+func drop(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	conn.Close()
+}
+
+// corruptWriter inverts first byte of response body
+type corruptWriter struct {
+	http.ResponseWriter
+	corrupted bool
+}
+
+func (w *corruptWriter) Write(b []byte) (int, error) {
+	if w.corrupted || len(b) == 0 {
+		return w.ResponseWriter.Write(b)
+	}
+	w.corrupted = true
+	data := make([]byte, len(b))
+	copy(data, b)
+	data[0] ^= 0xff
+	return w.ResponseWriter.Write(data)
+}
+
+// lockedRand is source of random numbers safe for concurrent use
+type lockedRand struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (r *lockedRand) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.Float64()
+}
+
+func (r *lockedRand) Intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.Intn(n)
+}
+
+func (r *lockedRand) Perm(n int) []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.Perm(n)
+}
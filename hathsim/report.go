@@ -0,0 +1,136 @@
+package hathsim
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Latency is distribution of response latencies
+type Latency struct {
+	Mean time.Duration `json:"mean"`
+	P50  time.Duration `json:"p50"`
+	P95  time.Duration `json:"p95"`
+	P99  time.Duration `json:"p99"`
+	Max  time.Duration `json:"max"`
+}
+
+// newLatency calculates distribution of samples
+func newLatency(samples []time.Duration) (l Latency) {
+	if len(samples) == 0 {
+		return l
+	}
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	percentile := func(p int) time.Duration {
+		return sorted[(len(sorted)-1)*p/100]
+	}
+	l.Mean = total / time.Duration(len(sorted))
+	l.P50 = percentile(50)
+	l.P95 = percentile(95)
+	l.P99 = percentile(99)
+	l.Max = sorted[len(sorted)-1]
+	return l
+}
+
+// Traffic is result of synthetic /h/ requests
+type Traffic struct {
+	Requests int `json:"requests"`
+	// Hits is count of files served with valid content
+	Hits int `json:"hits"`
+	// Misses is count of not found files
+	Misses int `json:"misses"`
+	// Corrupted is count of files served with bad hash
+	Corrupted int `json:"corrupted"`
+	// Errors is count of failed requests and unexpected statuses
+	Errors  int     `json:"errors"`
+	Latency Latency `json:"latency"`
+
+	samples []time.Duration
+}
+
+// HitRatio is ratio of hits to all requests
+func (t Traffic) HitRatio() float64 {
+	if t.Requests == 0 {
+		return 0
+	}
+	return float64(t.Hits) / float64(t.Requests)
+}
+
+func (t *Traffic) add(r result) {
+	t.Requests++
+	switch r.outcome {
+	case outcomeHit:
+		t.Hits++
+	case outcomeMiss:
+		t.Misses++
+	case outcomeCorrupted:
+		t.Corrupted++
+	default:
+		t.Errors++
+	}
+	if r.outcome != outcomeError {
+		t.samples = append(t.samples, r.latency)
+	}
+}
+
+func (t *Traffic) finish() {
+	t.Latency = newLatency(t.samples)
+	t.samples = nil
+}
+
+// Tests is result of commands sent to nodes
+type Tests struct {
+	Passed int `json:"passed"`
+	Failed int `json:"failed"`
+}
+
+// NodeReport is result of simulation for single node
+type NodeReport struct {
+	ID    int    `json:"id"`
+	URL   string `json:"url"`
+	Fault Fault  `json:"fault"`
+	// Cached is count of files cached by cache_files
+	Cached  int     `json:"cached"`
+	Traffic Traffic `json:"traffic"`
+}
+
+// Report is result of simulation
+type Report struct {
+	Duration time.Duration `json:"duration"`
+	Traffic  Traffic       `json:"traffic"`
+	// CacheFiles is result of every file in cache_files commands
+	CacheFiles Tests `json:"cache_files"`
+	// ProxyTests is result of proxy_test commands between nodes
+	ProxyTests Tests `json:"proxy_tests"`
+	// ThreadedTests is result of every download of
+	// threaded_proxy_test commands between nodes
+	ThreadedTests Tests        `json:"threaded_tests"`
+	Nodes         []NodeReport `json:"nodes"`
+}
+
+func writeTraffic(w io.Writer, name string, t Traffic) {
+	fmt.Fprintf(w, "%-8s requests=%d hits=%d misses=%d corrupted=%d errors=%d hit_ratio=%.3f\n",
+		name, t.Requests, t.Hits, t.Misses, t.Corrupted, t.Errors, t.HitRatio())
+	fmt.Fprintf(w, "%-8s latency mean=%s p50=%s p95=%s p99=%s max=%s\n",
+		"", t.Latency.Mean, t.Latency.P50, t.Latency.P95, t.Latency.P99, t.Latency.Max)
+}
+
+// Print writes human readable report
+func (r Report) Print(w io.Writer) {
+	fmt.Fprintln(w, "simulation completed in", r.Duration)
+	fmt.Fprintf(w, "cache_files: passed=%d failed=%d\n", r.CacheFiles.Passed, r.CacheFiles.Failed)
+	fmt.Fprintf(w, "proxy_test: passed=%d failed=%d\n", r.ProxyTests.Passed, r.ProxyTests.Failed)
+	fmt.Fprintf(w, "threaded_proxy_test: passed=%d failed=%d\n", r.ThreadedTests.Passed, r.ThreadedTests.Failed)
+	writeTraffic(w, "total", r.Traffic)
+	for _, n := range r.Nodes {
+		fmt.Fprintf(w, "node %d %s cached=%d fault=%+v\n", n.ID, n.URL, n.Cached, n.Fault)
+		writeTraffic(w, "", n.Traffic)
+	}
+}
@@ -0,0 +1,405 @@
+// Package hathsim simulates network of hath servers that use fake rpc
+// servers, generates synthetic traffic and injects faults between nodes
+package hathsim
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ernado/hath"
+	"github.com/ernado/hath/hathtest"
+)
+
+var (
+	// ErrNotEnoughNodes is returned when network has less than two nodes
+	ErrNotEnoughNodes = errors.New("At least two nodes are required")
+)
+
+// Config of simulation
+type Config struct {
+	// Nodes is count of servers in network
+	Nodes int
+	// Files is count of files available on rpc servers
+	Files int
+	// FileSize is size of every file
+	FileSize int64
+	// CachedFiles is count of random files cached on every
+	// node by cache_files before traffic is generated
+	CachedFiles int
+	// Requests is count of synthetic /h/ requests
+	Requests int
+	// Concurrency is count of concurrent requests
+	Concurrency int
+	// ZipfS is exponent of file popularity distribution, must be > 1
+	ZipfS float64
+	// ProxyTests is count of proxy_test commands between random nodes
+	ProxyTests int
+	// ThreadedTests is count of threaded_proxy_test commands
+	ThreadedTests int
+	// ThreadedSize is size of single threaded_proxy_test download
+	ThreadedSize int64
+	// ThreadedCount is count of downloads in threaded_proxy_test
+	ThreadedCount int
+	// Faults are injected into responses of nodes by index
+	Faults map[int]Fault
+	// Timeout of single request
+	Timeout time.Duration
+	// Seed of random generator
+	Seed int64
+	// Dir is directory for node files, temporary by default
+	Dir string
+}
+
+// PopulateDefaults sets default values for zero fields
+func (cfg *Config) PopulateDefaults() {
+	if cfg.Nodes == 0 {
+		cfg.Nodes = 3
+	}
+	if cfg.Files == 0 {
+		cfg.Files = 100
+	}
+	if cfg.FileSize == 0 {
+		cfg.FileSize = 16 * 1024
+	}
+	if cfg.CachedFiles == 0 {
+		cfg.CachedFiles = cfg.Files / 2
+	}
+	if cfg.CachedFiles > cfg.Files {
+		cfg.CachedFiles = cfg.Files
+	}
+	if cfg.Requests == 0 {
+		cfg.Requests = 1000
+	}
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = 8
+	}
+	if cfg.ZipfS <= 1 {
+		cfg.ZipfS = 1.1
+	}
+	if cfg.ProxyTests == 0 {
+		cfg.ProxyTests = cfg.Nodes * 2
+	}
+	if cfg.ThreadedTests == 0 {
+		cfg.ThreadedTests = cfg.Nodes
+	}
+	if cfg.ThreadedSize == 0 {
+		cfg.ThreadedSize = 64 * 1024
+	}
+	if cfg.ThreadedCount == 0 {
+		cfg.ThreadedCount = 4
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = time.Second * 10
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = time.Now().UnixNano()
+	}
+}
+
+// Node is hath server in simulated network with its own rpc server
+type Node struct {
+	ID     int
+	URL    string
+	RPC    *hathtest.Server
+	Server *hath.DefaultServer
+	Fault  Fault
+
+	http   *httptest.Server
+	cached []hath.File
+}
+
+// Network is set of nodes with shared files
+type Network struct {
+	Nodes []*Node
+
+	cfg    Config
+	dir    string
+	rnd    *lockedRand
+	files  []hath.File
+	client *http.Client
+}
+
+// New starts network of nodes
+func New(cfg Config) (*Network, error) {
+	cfg.PopulateDefaults()
+	if cfg.Nodes < 2 {
+		return nil, ErrNotEnoughNodes
+	}
+	dir, err := ioutil.TempDir(cfg.Dir, "hathsim")
+	if err != nil {
+		return nil, err
+	}
+	n := &Network{
+		cfg:    cfg,
+		dir:    dir,
+		rnd:    newLockedRand(cfg.Seed),
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+	data := make(map[hath.File][]byte)
+	for i := 0; i < cfg.Files; i++ {
+		f, content := hathtest.RandomFile(cfg.FileSize)
+		n.files = append(n.files, f)
+		data[f] = content
+	}
+	for i := 0; i < cfg.Nodes; i++ {
+		node, err := n.startNode(i, data)
+		if err != nil {
+			n.Close()
+			return nil, err
+		}
+		n.Nodes = append(n.Nodes, node)
+	}
+	return n, nil
+}
+
+func (n *Network) startNode(id int, data map[hath.File][]byte) (*Node, error) {
+	node := &Node{ID: id, Fault: n.cfg.Faults[id]}
+	node.RPC = hathtest.NewServer(int64(id+1), fmt.Sprintf("hathsimkey%d", id+1))
+	for f, content := range data {
+		node.RPC.AddFile(f, content)
+	}
+	dir := path.Join(n.dir, fmt.Sprintf("node%d", id))
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		node.RPC.Close()
+		return nil, err
+	}
+	db, err := hath.NewDB(path.Join(dir, "hath.db"))
+	if err != nil {
+		node.RPC.Close()
+		return nil, err
+	}
+	client := node.RPC.Client()
+	cfg := hath.ServerConfig{}
+	cfg.Credentials = hath.Credentials{ClientID: node.RPC.ClientID, Key: node.RPC.Key}
+	cfg.Client = client
+	cfg.DataBase = db
+	cfg.Frontend = hath.NewFrontend(dir)
+	cfg.UpdateRate = time.Millisecond * 100
+	node.Server = hath.NewServer(cfg)
+	if err := node.Server.Start(); err != nil {
+		db.Close()
+		node.RPC.Close()
+		return nil, err
+	}
+	node.http = httptest.NewServer(node.Fault.Handler(node.Server, n.rnd))
+	node.URL = node.http.URL
+	if err := client.Start(); err != nil {
+		node.close()
+		return nil, err
+	}
+	return node, nil
+}
+
+func (node *Node) close() error {
+	node.http.Close()
+	err := node.Server.Close()
+	node.RPC.Close()
+	return err
+}
+
+// Close stops all nodes and removes their files
+func (n *Network) Close() error {
+	var err error
+	for _, node := range n.Nodes {
+		if closeErr := node.close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	n.Nodes = nil
+	if removeErr := os.RemoveAll(n.dir); removeErr != nil && err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// Run warms caches of nodes, sends proxy tests between them,
+// generates synthetic traffic and reports results
+func (n *Network) Run() (r Report, err error) {
+	start := time.Now()
+	if r.CacheFiles, err = n.cacheFiles(); err != nil {
+		return r, err
+	}
+	r.ProxyTests = n.proxyTests()
+	r.ThreadedTests = n.threadedTests()
+	traffic := n.traffic()
+	for i, node := range n.Nodes {
+		r.Traffic.Requests += traffic[i].Requests
+		r.Traffic.Hits += traffic[i].Hits
+		r.Traffic.Misses += traffic[i].Misses
+		r.Traffic.Corrupted += traffic[i].Corrupted
+		r.Traffic.Errors += traffic[i].Errors
+		r.Traffic.samples = append(r.Traffic.samples, traffic[i].samples...)
+		traffic[i].finish()
+		r.Nodes = append(r.Nodes, NodeReport{
+			ID:      node.ID,
+			URL:     node.URL,
+			Fault:   node.Fault,
+			Cached:  len(node.cached),
+			Traffic: traffic[i],
+		})
+	}
+	r.Traffic.finish()
+	r.Duration = time.Since(start)
+	return r, nil
+}
+
+// cacheFiles sends cache_files with random files to every node
+func (n *Network) cacheFiles() (t Tests, err error) {
+	for _, node := range n.Nodes {
+		var files []hath.File
+		for _, i := range n.rnd.Perm(len(n.files))[:n.cfg.CachedFiles] {
+			files = append(files, n.files[i])
+		}
+		statuses, err := node.RPC.CacheFiles(node.URL, files...)
+		if err != nil {
+			return t, err
+		}
+		for _, f := range files {
+			if statuses[f.String()] == "OK" {
+				t.Passed++
+				node.cached = append(node.cached, f)
+				continue
+			}
+			t.Failed++
+		}
+	}
+	return t, nil
+}
+
+// peers returns two random distinct nodes
+func (n *Network) peers() (node, peer *Node) {
+	i := n.rnd.Intn(len(n.Nodes))
+	j := (i + 1 + n.rnd.Intn(len(n.Nodes)-1)) % len(n.Nodes)
+	return n.Nodes[i], n.Nodes[j]
+}
+
+// proxyTests makes random nodes download cached files from peers
+func (n *Network) proxyTests() (t Tests) {
+	for i := 0; i < n.cfg.ProxyTests; i++ {
+		node, peer := n.peers()
+		if len(peer.cached) == 0 {
+			t.Failed++
+			continue
+		}
+		f := peer.cached[n.rnd.Intn(len(peer.cached))]
+		statuses, err := node.RPC.ProxyTest(node.URL, peer.RPC, peer.URL, f)
+		if err != nil || !strings.HasPrefix(statuses[f.String()], "OK") {
+			t.Failed++
+			continue
+		}
+		t.Passed++
+	}
+	return t
+}
+
+// threadedTests makes random nodes download speed tests from peers
+func (n *Network) threadedTests() (t Tests) {
+	for i := 0; i < n.cfg.ThreadedTests; i++ {
+		node, peer := n.peers()
+		passed, _, err := node.RPC.ThreadedProxyTest(node.URL, peer.RPC, peer.URL,
+			n.cfg.ThreadedSize, n.cfg.ThreadedCount)
+		if err != nil {
+			passed = 0
+		}
+		t.Passed += passed
+		t.Failed += n.cfg.ThreadedCount - passed
+	}
+	return t
+}
+
+type outcome int
+
+const (
+	outcomeError outcome = iota
+	outcomeHit
+	outcomeMiss
+	outcomeCorrupted
+)
+
+type job struct {
+	node int
+	file hath.File
+}
+
+type result struct {
+	node    int
+	outcome outcome
+	latency time.Duration
+}
+
+// traffic sends synthetic requests of popular files to random
+// nodes and returns results by node
+func (n *Network) traffic() []Traffic {
+	var (
+		jobs    = make(chan job)
+		results = make(chan result)
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < n.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results <- n.request(j)
+			}
+		}()
+	}
+	go func() {
+		rnd := rand.New(rand.NewSource(n.cfg.Seed))
+		zipf := rand.NewZipf(rnd, n.cfg.ZipfS, 1, uint64(len(n.files)-1))
+		for i := 0; i < n.cfg.Requests; i++ {
+			jobs <- job{
+				node: rnd.Intn(len(n.Nodes)),
+				file: n.files[zipf.Uint64()],
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+	traffic := make([]Traffic, len(n.Nodes))
+	for r := range results {
+		traffic[r.node].add(r)
+	}
+	return traffic
+}
+
+// request downloads file from node and verifies its hash
+func (n *Network) request(j job) (r result) {
+	r.node = j.node
+	node := n.Nodes[j.node]
+	start := time.Now()
+	res, err := n.client.Get(node.RPC.ImageURL(node.URL, j.file))
+	if err != nil {
+		return r
+	}
+	defer res.Body.Close()
+	h := sha1.New()
+	_, err = io.Copy(h, res.Body)
+	r.latency = time.Since(start)
+	switch {
+	case err != nil:
+		r.outcome = outcomeError
+	case res.StatusCode == http.StatusNotFound:
+		r.outcome = outcomeMiss
+	case res.StatusCode != http.StatusOK:
+		r.outcome = outcomeError
+	case !bytes.Equal(h.Sum(nil), j.file.Hash[:]):
+		r.outcome = outcomeCorrupted
+	default:
+		r.outcome = outcomeHit
+	}
+	return r
+}
@@ -0,0 +1,116 @@
+package hathsim
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLatency(t *testing.T) {
+	Convey("Latency", t, func() {
+		So(newLatency(nil), ShouldResemble, Latency{})
+		var samples []time.Duration
+		for i := 100; i > 0; i-- {
+			samples = append(samples, time.Duration(i)*time.Millisecond)
+		}
+		l := newLatency(samples)
+		So(l.P50, ShouldEqual, time.Millisecond*50)
+		So(l.P99, ShouldEqual, time.Millisecond*99)
+		So(l.Max, ShouldEqual, time.Millisecond*100)
+		So(l.Mean, ShouldEqual, time.Microsecond*50500)
+	})
+}
+
+func TestFault(t *testing.T) {
+	Convey("Fault", t, func() {
+		data := []byte("content")
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(data)
+		})
+		rnd := newLockedRand(1)
+		get := func(f Fault, path string) ([]byte, error) {
+			ts := httptest.NewServer(f.Handler(h, rnd))
+			defer ts.Close()
+			res, err := http.Get(ts.URL + path)
+			if err != nil {
+				return nil, err
+			}
+			defer res.Body.Close()
+			return ioutil.ReadAll(res.Body)
+		}
+		body, err := get(Fault{}, "/h/")
+		So(err, ShouldBeNil)
+		So(body, ShouldResemble, data)
+		body, err = get(Fault{CorruptRate: 1}, "/h/")
+		So(err, ShouldBeNil)
+		So(bytes.Equal(body, data), ShouldBeFalse)
+		So(body[1:], ShouldResemble, data[1:])
+		_, err = get(Fault{DropRate: 1}, "/h/")
+		So(err, ShouldNotBeNil)
+		Convey("Server commands", func() {
+			body, err := get(Fault{DropRate: 1, CorruptRate: 1}, "/servercmd/still_alive")
+			So(err, ShouldBeNil)
+			So(body, ShouldResemble, data)
+		})
+	})
+}
+
+func TestNetwork(t *testing.T) {
+	Convey("Network", t, func() {
+		_, err := New(Config{Nodes: 1})
+		So(err, ShouldEqual, ErrNotEnoughNodes)
+
+		cfg := Config{
+			Nodes:         3,
+			Files:         20,
+			FileSize:      1024,
+			CachedFiles:   20,
+			Requests:      60,
+			ProxyTests:    6,
+			ThreadedTests: 3,
+			ThreadedSize:  1024,
+			ThreadedCount: 2,
+			Seed:          1,
+		}
+		Convey("Healthy", func() {
+			n, err := New(cfg)
+			So(err, ShouldBeNil)
+			defer n.Close()
+			r, err := n.Run()
+			So(err, ShouldBeNil)
+			So(r.CacheFiles, ShouldResemble, Tests{Passed: 60})
+			So(r.ProxyTests, ShouldResemble, Tests{Passed: 6})
+			So(r.ThreadedTests, ShouldResemble, Tests{Passed: 6})
+			So(r.Traffic.Requests, ShouldEqual, 60)
+			So(r.Traffic.HitRatio(), ShouldEqual, 1)
+			So(r.Traffic.Latency.Max, ShouldBeGreaterThan, 0)
+			So(r.Nodes, ShouldHaveLength, 3)
+			var buf bytes.Buffer
+			r.Print(&buf)
+			So(buf.String(), ShouldContainSubstring, "hit_ratio=1.000")
+		})
+		Convey("Faulty", func() {
+			cfg.CachedFiles = 10
+			cfg.Faults = map[int]Fault{
+				0: {DropRate: 1},
+				1: {CorruptRate: 1, Latency: time.Millisecond * 5},
+			}
+			n, err := New(cfg)
+			So(err, ShouldBeNil)
+			defer n.Close()
+			r, err := n.Run()
+			So(err, ShouldBeNil)
+			So(r.Nodes[0].Traffic.Errors, ShouldEqual, r.Nodes[0].Traffic.Requests)
+			So(r.Nodes[1].Traffic.Hits, ShouldEqual, 0)
+			So(r.Nodes[1].Traffic.Latency.P50, ShouldBeGreaterThanOrEqualTo, time.Millisecond*5)
+			So(r.Nodes[2].Traffic.Corrupted+r.Nodes[2].Traffic.Errors, ShouldEqual, 0)
+			So(r.Traffic.HitRatio(), ShouldBeLessThan, 1)
+			So(r.ProxyTests.Passed+r.ProxyTests.Failed, ShouldEqual, 6)
+		})
+	})
+}
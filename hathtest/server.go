@@ -0,0 +1,514 @@
+// Package hathtest provides in-process fake hath rpc server
+// for offline integration testing of hath clients
+package hathtest
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ernado/hath"
+)
+
+// protocol constants, duplicated here to verify
+// client implementation independently
+const (
+	// APIPath is path of rpc api
+	APIPath = "/clientapi.php"
+	// ImagePath is path of image delivery for cache_files downloads
+	ImagePath = "/image.php"
+	// RequestPath is path prefix of image delivery for proxy requests
+	RequestPath = "/r/"
+
+	actionKeyStart    = "hentai@home"
+	commandKeyStart   = "hentai@home-servercmd"
+	speedTestKeyStart = "hentai@home-speedtest"
+	keyDelimiter      = "-"
+	maximumTimeLag    = 600
+	minClientBuild    = 1
+
+	argAction         = "act"
+	argActionArgument = "add"
+	argActionKey      = "actkey"
+	argTime           = "acttime"
+	argClientID       = "cid"
+
+	responseOK         = "OK"
+	responseKeyExpired = "KEY_EXPIRED"
+	responseBadKey     = "FAIL_INVALID_ACTKEY"
+	responseBadAction  = "INVALID_ACTION"
+
+	fileDelimiter = ";"
+	tokenLength   = 10
+)
+
+// Server is fake hath rpc server with image delivery
+type Server struct {
+	// URL is base url of server
+	URL      string
+	ClientID int64
+	Key      string
+
+	srv        *httptest.Server
+	mu         sync.Mutex
+	offset     time.Duration
+	settings   map[string]string
+	files      map[string][]byte
+	registered map[string]bool
+	blacklist  []string
+	calls      map[string]int
+	failures   int
+}
+
+// NewServer starts fake rpc server for client with provided credentials
+func NewServer(clientID int64, key string) *Server {
+	s := &Server{
+		ClientID:   clientID,
+		Key:        key,
+		files:      make(map[string][]byte),
+		registered: make(map[string]bool),
+		calls:      make(map[string]int),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(APIPath, s.handleAction)
+	mux.HandleFunc(ImagePath, s.handleImage)
+	mux.HandleFunc(RequestPath, s.handleRequest)
+	s.srv = httptest.NewServer(mux)
+	s.URL = s.srv.URL
+	s.settings = map[string]string{
+		"port":               "0",
+		"host":               "127.0.0.1",
+		"name":               "hathtest",
+		"throttle_bytes":     "0",
+		"disklimit_bytes":    strconv.FormatInt(1024*1024*1024, 10),
+		"request_proxy_mode": "1",
+		"request_server":     s.Host(),
+		"image_server":       s.Host(),
+		"rpc_server_ip":      "127.0.0.1",
+		"static_ranges":      "",
+	}
+	return s
+}
+
+// Close stops server
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Host returns host:port of server
+func (s *Server) Host() string {
+	u, _ := url.Parse(s.URL)
+	return u.Host
+}
+
+// ClientConfig returns config of client that uses server
+func (s *Server) ClientConfig() hath.ClientConfig {
+	base, _ := url.Parse(s.URL + APIPath)
+	return hath.ClientConfig{
+		Credentials:     hath.Credentials{ClientID: s.ClientID, Key: s.Key},
+		BaseURL:         base,
+		RetryBackoff:    time.Millisecond,
+		MaxRetryBackoff: time.Millisecond * 10,
+	}
+}
+
+// Client returns new client that uses server
+func (s *Server) Client() *hath.Client {
+	return hath.NewClient(s.ClientConfig())
+}
+
+// Now returns time of server
+func (s *Server) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().Add(s.offset)
+}
+
+// SetTimeOffset sets difference between server time and local time
+func (s *Server) SetTimeOffset(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset = d
+}
+
+// SetSetting sets value returned in client_settings
+func (s *Server) SetSetting(k, v string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings[k] = v
+}
+
+// AddFile makes file available for download from server
+func (s *Server) AddFile(f hath.File, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[f.String()] = data
+}
+
+// Blacklist adds files to blacklist returned by get_blacklist
+func (s *Server) Blacklist(files ...hath.File) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range files {
+		s.blacklist = append(s.blacklist, f.String())
+	}
+}
+
+// Registered returns sorted ids of files registered by client
+func (s *Server) Registered() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id := range s.registered {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// IsRegistered returns true if file is registered by client
+func (s *Server) IsRegistered(f hath.File) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.registered[f.String()]
+}
+
+// Calls returns count of verified calls of action
+func (s *Server) Calls(action string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[action]
+}
+
+// Failures returns count of calls with bad action key or time
+func (s *Server) Failures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures
+}
+
+// Token returns download token for file
+func (s *Server) Token(f hath.File) string {
+	return sha1Hex(s.Key, "token", f.String())[:tokenLength]
+}
+
+// ActionKey returns expected action key of rpc call
+func (s *Server) ActionKey(action, argument string, timestamp int64) string {
+	return sha1Hex(strings.Join([]string{
+		actionKeyStart,
+		action,
+		argument,
+		strconv.FormatInt(s.ClientID, 10),
+		strconv.FormatInt(timestamp, 10),
+		s.Key,
+	}, keyDelimiter))
+}
+
+// CommandKey returns signature of server command
+func (s *Server) CommandKey(command, kwds string, timestamp int64) string {
+	return sha1Hex(strings.Join([]string{
+		commandKeyStart,
+		command,
+		kwds,
+		strconv.FormatInt(s.ClientID, 10),
+		strconv.FormatInt(timestamp, 10),
+		s.Key,
+	}, keyDelimiter))
+}
+
+// CommandURL returns signed url of server command for client at clientURL
+func (s *Server) CommandURL(clientURL, command, kwds string) string {
+	if len(kwds) == 0 {
+		kwds = "-"
+	}
+	timestamp := s.Now().Unix()
+	return fmt.Sprintf("%s/servercmd/%s/%s/%d/%s",
+		strings.TrimRight(clientURL, "/"),
+		command,
+		url.PathEscape(kwds),
+		timestamp,
+		s.CommandKey(command, kwds, timestamp),
+	)
+}
+
+// Command sends signed server command to client at clientURL
+// and returns response body
+func (s *Server) Command(clientURL, command, kwds string) (string, error) {
+	res, err := http.Get(s.CommandURL(clientURL, command, kwds))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return string(body), fmt.Errorf("hathtest: command %s failed with status %d: %s", command, res.StatusCode, body)
+	}
+	return string(body), nil
+}
+
+// CacheFiles sends cache_files command for files available on
+// server and returns status of every file by id
+func (s *Server) CacheFiles(clientURL string, files ...hath.File) (map[string]string, error) {
+	var args []string
+	for _, f := range files {
+		args = append(args, fmt.Sprintf("%s:%s=%s", f, s.Host(), s.Token(f)))
+	}
+	body, err := s.Command(clientURL, "cache_files", strings.Join(args, ";"))
+	if err != nil {
+		return nil, err
+	}
+	return parseStatuses(body), nil
+}
+
+// KeyStamp returns current keystamp of file in form of timestamp-stamp
+func (s *Server) KeyStamp(f hath.File) string {
+	timestamp := s.Now().Unix()
+	return fmt.Sprintf("%d-%s", timestamp, f.KeyStamp(s.Key, timestamp))
+}
+
+// SpeedTestKey returns key of threaded proxy test for client
+func (s *Server) SpeedTestKey(size, timestamp int64) string {
+	return sha1Hex(strings.Join([]string{
+		speedTestKeyStart,
+		strconv.FormatInt(size, 10),
+		strconv.FormatInt(timestamp, 10),
+		strconv.FormatInt(s.ClientID, 10),
+		s.Key,
+	}, keyDelimiter))
+}
+
+// ProxyTest sends proxy_test command that makes client download
+// file from peer client at peerURL, which uses peer rpc server
+func (s *Server) ProxyTest(clientURL string, peer *Server, peerURL string, f hath.File) (map[string]string, error) {
+	host, port, err := splitURL(peerURL)
+	if err != nil {
+		return nil, err
+	}
+	kwds := fmt.Sprintf("ipaddr=%s;port=%s;fileid=%s;keystamp=%s",
+		host, port, f, peer.KeyStamp(f))
+	body, err := s.Command(clientURL, "proxy_test", kwds)
+	if err != nil {
+		return nil, err
+	}
+	return parseStatuses(body), nil
+}
+
+// ThreadedProxyTest sends threaded_proxy_test command that makes client
+// download count speed tests of size from peer client at peerURL
+// and returns count of passed tests with their total duration
+func (s *Server) ThreadedProxyTest(clientURL string, peer *Server, peerURL string, size int64, count int) (int, time.Duration, error) {
+	host, port, err := splitURL(peerURL)
+	if err != nil {
+		return 0, 0, err
+	}
+	timestamp := peer.Now().Unix()
+	kwds := fmt.Sprintf("ipaddr=%s;port=%s;testsize=%d;testcount=%d;testtime=%d;testkey=%s",
+		host, port, size, count, timestamp, peer.SpeedTestKey(size, timestamp))
+	body, err := s.Command(clientURL, "threaded_proxy_test", kwds)
+	if err != nil {
+		return 0, 0, err
+	}
+	var passed, milliseconds int64
+	if _, err := fmt.Sscanf(strings.TrimSpace(body), responseOK+":%d-%d", &passed, &milliseconds); err != nil {
+		return 0, 0, fmt.Errorf("hathtest: bad threaded_proxy_test response %q", body)
+	}
+	return int(passed), time.Duration(milliseconds) * time.Millisecond, nil
+}
+
+// ImageURL returns url of file on client with valid keystamp
+func (s *Server) ImageURL(clientURL string, f hath.File) string {
+	return fmt.Sprintf("%s/h/%s/keystamp=%s/%s.%s",
+		strings.TrimRight(clientURL, "/"), f, s.KeyStamp(f), f.HexID(), f.Type)
+}
+
+// ProxyURL returns url of gallery proxy request of file on client
+func (s *Server) ProxyURL(clientURL string, f hath.File) string {
+	return fmt.Sprintf("%s/p/fileid=%s;token=%s;gid=1;page=1/%s.%s",
+		strings.TrimRight(clientURL, "/"), f, s.Token(f), f.HexID(), f.Type)
+}
+
+// RandomFile returns random file info with its content
+func RandomFile(size int64) (hath.File, []byte) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		panic(err)
+	}
+	f := hath.File{
+		Hash:   sha1.Sum(data),
+		Type:   hath.JPG,
+		Size:   size,
+		Width:  100,
+		Height: 100,
+	}
+	return f, data
+}
+
+func (s *Server) handleAction(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	action := q.Get(argAction)
+	argument := q.Get(argActionArgument)
+	timestamp, err := strconv.ParseInt(q.Get(argTime), 10, 64)
+	if err != nil || q.Get(argClientID) != strconv.FormatInt(s.ClientID, 10) {
+		s.fail(w, responseBadKey)
+		return
+	}
+	if q.Get(argActionKey) != s.ActionKey(action, argument, timestamp) {
+		s.fail(w, responseBadKey)
+		return
+	}
+	// server_stat is not checked for time lag, because
+	// client uses it to measure time offset
+	delta := s.Now().Unix() - timestamp
+	if action != "server_stat" && (delta > maximumTimeLag || delta < -maximumTimeLag) {
+		s.fail(w, responseKeyExpired)
+		return
+	}
+
+	w.Header().Set("Date", s.Now().UTC().Format(http.TimeFormat))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[action]++
+	lines := []string{responseOK}
+	switch action {
+	case "client_start", "client_login", "still_alive", "client_suspend",
+		"client_resume", "client_stop", "overload", "more_files":
+	case "server_stat":
+		lines = append(lines,
+			fmt.Sprintf("min_client_build=%d", minClientBuild),
+			fmt.Sprintf("server_time=%d", time.Now().Add(s.offset).Unix()),
+		)
+	case "client_settings":
+		var keys []string
+		for k := range s.settings {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			lines = append(lines, k+"="+s.settings[k])
+		}
+	case "file_register":
+		for _, id := range splitFiles(argument) {
+			s.registered[id] = true
+		}
+	case "file_uncache":
+		for _, id := range splitFiles(argument) {
+			delete(s.registered, id)
+		}
+	case "download_list":
+		for _, id := range splitFiles(argument) {
+			f, err := hath.FileFromID(id)
+			if err != nil {
+				continue
+			}
+			lines = append(lines, id+" "+s.Token(f))
+		}
+	case "get_blacklist":
+		lines = append(lines, strings.Join(s.blacklist, fileDelimiter))
+	default:
+		s.calls[action]--
+		lines = []string{responseBadAction}
+	}
+	fmt.Fprint(w, strings.Join(lines, "\n"))
+}
+
+func (s *Server) fail(w http.ResponseWriter, response string) {
+	s.mu.Lock()
+	s.failures++
+	s.mu.Unlock()
+	fmt.Fprint(w, response)
+}
+
+// deliver writes file content if token is valid
+func (s *Server) deliver(w http.ResponseWriter, id, token string) {
+	f, err := hath.FileFromID(id)
+	if err != nil || token != s.Token(f) {
+		http.Error(w, "403: bad token", http.StatusForbidden)
+		return
+	}
+	s.mu.Lock()
+	data, ok := s.files[id]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, nil)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// handleImage serves file for cache_files download
+// GET /image.php?f=<fileid>&t=<token>
+func (s *Server) handleImage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s.deliver(w, q.Get("f"), q.Get("t"))
+}
+
+// handleRequest serves file for proxy request
+// GET /r/<fileid>/<token>/<gallery>-<page>/<filename>
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	elems := strings.Split(strings.TrimPrefix(r.URL.Path, RequestPath), "/")
+	if len(elems) != 4 {
+		http.NotFound(w, r)
+		return
+	}
+	id := elems[0]
+	expected := fmt.Sprintf("%d-%s", s.ClientID, sha1Hex(s.Key, id))
+	if r.Header.Get("Hath-Request") != expected {
+		http.Error(w, "403: bad hath request", http.StatusForbidden)
+		return
+	}
+	s.deliver(w, id, elems[1])
+}
+
+// splitURL returns host and port of url
+func splitURL(rawURL string) (host, port string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+	return net.SplitHostPort(u.Host)
+}
+
+func splitFiles(argument string) (ids []string) {
+	for _, id := range strings.Split(argument, fileDelimiter) {
+		if len(id) != 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// parseStatuses parses lines of fileid:status from command response
+func parseStatuses(body string) map[string]string {
+	statuses := make(map[string]string)
+	for _, line := range strings.Split(body, "\n") {
+		elems := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(elems) != 2 {
+			continue
+		}
+		statuses[elems[0]] = elems[1]
+	}
+	return statuses
+}
+
+func sha1Hex(args ...string) string {
+	h := sha1.New()
+	for _, arg := range args {
+		io.WriteString(h, arg)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
@@ -0,0 +1,126 @@
+package hathtest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ernado/hath"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// waitFor polls condition until it is true or timeout is reached
+func waitFor(condition func() bool) bool {
+	deadline := time.Now().Add(time.Second * 2)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return condition()
+}
+
+func TestServer(t *testing.T) {
+	Convey("Fake rpc server", t, func() {
+		rpc := NewServer(1337, "testkey")
+		defer rpc.Close()
+
+		Convey("Action key", func() {
+			c := rpc.Client()
+			So(c.StillAlive(), ShouldBeNil)
+			So(rpc.Calls("still_alive"), ShouldEqual, 1)
+			cfg := rpc.ClientConfig()
+			cfg.Key = "badkey"
+			So(hath.NewClient(cfg).StillAlive(), ShouldNotBeNil)
+			So(rpc.Failures(), ShouldEqual, 1)
+			So(rpc.Calls("still_alive"), ShouldEqual, 1)
+		})
+
+		for _, offset := range []time.Duration{0, time.Hour} {
+			Convey("Lifecycle with time offset "+offset.String(), func() {
+				rpc.SetTimeOffset(offset)
+				static, staticData := RandomFile(2048)
+				rpc.AddFile(static, staticData)
+				rpc.SetSetting("static_ranges", static.HexID()[:4])
+				rpc.SetSetting("request_proxy_mode", "3")
+				proxied, proxiedData := RandomFile(4096)
+				rpc.AddFile(proxied, proxiedData)
+				testDir, err := ioutil.TempDir("", "hathtest")
+				So(err, ShouldBeNil)
+				defer os.RemoveAll(testDir)
+				db, err := hath.NewDB(path.Join(testDir, "bolt.db"))
+				So(err, ShouldBeNil)
+
+				c := rpc.Client()
+				cfg := hath.ServerConfig{}
+				cfg.Credentials = hath.Credentials{ClientID: rpc.ClientID, Key: rpc.Key}
+				cfg.Client = c
+				cfg.DataBase = db
+				cfg.Frontend = hath.NewFrontend(testDir)
+				cfg.UpdateRate = time.Millisecond * 10
+				cfg.DownloadRetries = -1
+				server := hath.NewServer(cfg)
+				So(server.Start(), ShouldBeNil)
+				So(rpc.Calls("server_stat"), ShouldEqual, 1)
+				So(rpc.Calls("client_login"), ShouldEqual, 1)
+				So(rpc.Calls("client_settings"), ShouldEqual, 1)
+				ts := httptest.NewServer(server)
+				defer ts.Close()
+				So(c.Start(), ShouldBeNil)
+				So(rpc.Calls("client_start"), ShouldEqual, 1)
+
+				body, err := rpc.Command(ts.URL, "still_alive", "")
+				So(err, ShouldBeNil)
+				So(body, ShouldContainSubstring, "alive")
+
+				f, data := RandomFile(1024)
+				rpc.AddFile(f, data)
+				statuses, err := rpc.CacheFiles(ts.URL, f)
+				So(err, ShouldBeNil)
+				So(statuses[f.String()], ShouldEqual, "OK")
+
+				get := func(u string) []byte {
+					res, err := http.Get(u)
+					So(err, ShouldBeNil)
+					defer res.Body.Close()
+					So(res.StatusCode, ShouldEqual, http.StatusOK)
+					served, err := ioutil.ReadAll(res.Body)
+					So(err, ShouldBeNil)
+					return served
+				}
+				So(get(rpc.ImageURL(ts.URL, f)), ShouldResemble, data)
+
+				// file from static range is downloaded on demand
+				So(get(rpc.ImageURL(ts.URL, static)), ShouldResemble, staticData)
+				So(rpc.Calls("download_list"), ShouldEqual, 1)
+
+				// proxied file is cached and registered
+				So(get(rpc.ProxyURL(ts.URL, proxied)), ShouldResemble, proxiedData)
+				So(waitFor(func() bool { return rpc.IsRegistered(proxied) }), ShouldBeTrue)
+				So(get(rpc.ImageURL(ts.URL, proxied)), ShouldResemble, proxiedData)
+
+				Convey("Bad signature", func() {
+					res, err := http.Get(ts.URL + "/servercmd/still_alive/-/1/bad")
+					So(err, ShouldBeNil)
+					res.Body.Close()
+					So(res.StatusCode, ShouldEqual, http.StatusUnauthorized)
+				})
+				Convey("Unknown file", func() {
+					other, _ := RandomFile(512)
+					statuses, err := rpc.CacheFiles(ts.URL, other)
+					So(err, ShouldBeNil)
+					So(statuses[other.String()], ShouldEqual, "FAIL")
+				})
+
+				So(server.Close(), ShouldBeNil)
+				So(rpc.Calls("client_stop"), ShouldEqual, 1)
+				So(rpc.Failures(), ShouldEqual, 0)
+			})
+		}
+	})
+}
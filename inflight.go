@@ -0,0 +1,225 @@
+package hath
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	// ErrDownloadFailed is returned when all download attempts failed
+	ErrDownloadFailed = errors.New("Failed to download file")
+)
+
+// download is in-flight upstream download of file, shared by all
+// concurrent requests of that file, which read data as it grows;
+// last byte is held back until hash of whole file is verified,
+// so corrupted file is never sent completely
+type download struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	size   int
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	data      []byte
+	done      bool
+	err       error
+	refs      int
+	committed bool
+}
+
+func newDownload(f File) *download {
+	d := &download{data: make([]byte, 0, f.Size), size: int(f.Size)}
+	d.cond = sync.NewCond(&d.mu)
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	return d
+}
+
+// Write appends downloaded data and wakes up readers
+func (d *download) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	d.data = append(d.data, p...)
+	d.mu.Unlock()
+	d.cond.Broadcast()
+	return len(p), nil
+}
+
+// finish marks download as completed with provided error
+func (d *download) finish(err error) {
+	d.mu.Lock()
+	d.done = true
+	d.err = err
+	d.mu.Unlock()
+	d.cond.Broadcast()
+	d.cancel()
+}
+
+// Bytes returns downloaded data
+func (d *download) Bytes() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.data
+}
+
+// available returns length of data that can be sent to users
+func (d *download) available() int {
+	n := len(d.data)
+	if n == d.size && n > 0 && (!d.done || d.err != nil) {
+		n--
+	}
+	return n
+}
+
+// watch wakes up waiters of download when ctx is done,
+// returned function stops watching
+func (d *download) watch(ctx context.Context) (stop func()) {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// waiter either checks ctx before waiting
+			// or is already waiting and is woken up
+			d.mu.Lock()
+			d.mu.Unlock()
+			d.cond.Broadcast()
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
+}
+
+// wait blocks until data is available, download is completed or
+// ctx is done, returning error only if download failed before any
+// data or ctx is done; download is committed after successful wait
+// and can not be reset
+func (d *download) wait(ctx context.Context) error {
+	defer d.watch(ctx)()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for d.available() == 0 && !d.done && ctx.Err() == nil {
+		d.cond.Wait()
+	}
+	if d.available() == 0 && d.err != nil {
+		return d.err
+	}
+	if d.available() == 0 && !d.done {
+		return ctx.Err()
+	}
+	d.committed = true
+	return nil
+}
+
+// reset discards downloaded data for retry if it
+// was not sent to users, returning true on success
+func (d *download) reset() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.committed {
+		return false
+	}
+	d.data = d.data[:0]
+	return true
+}
+
+// leave is called by request when it is not interested in download
+// anymore; download is canceled when no requests are left
+func (d *download) leave() {
+	d.mu.Lock()
+	d.refs--
+	abandoned := d.refs == 0 && !d.done
+	d.mu.Unlock()
+	if abandoned {
+		d.cancel()
+	}
+}
+
+// abandoned returns true if download was canceled before completion
+func (d *download) abandoned() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.done && d.ctx.Err() != nil
+}
+
+// NewReader returns reader of download data from the beginning,
+// that blocks until more data is downloaded or ctx is done
+func (d *download) NewReader(ctx context.Context) io.Reader {
+	return &downloadReader{d: d, ctx: ctx}
+}
+
+type downloadReader struct {
+	d      *download
+	ctx    context.Context
+	offset int
+}
+
+func (r *downloadReader) Read(p []byte) (int, error) {
+	d := r.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r.offset >= d.available() && !d.done {
+		// watching context only if reader has to wait
+		defer d.watch(r.ctx)()
+		for r.offset >= d.available() && !d.done && r.ctx.Err() == nil {
+			d.cond.Wait()
+		}
+	}
+	if available := d.available(); r.offset < available {
+		n := copy(p, d.data[r.offset:available])
+		r.offset += n
+		return n, nil
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	if !d.done {
+		return 0, r.ctx.Err()
+	}
+	return 0, io.EOF
+}
+
+// downloads is set of in-flight downloads by file hash
+type downloads struct {
+	mu     sync.Mutex
+	active map[[HashSize]byte]*download
+}
+
+func newDownloads() *downloads {
+	return &downloads{active: make(map[[HashSize]byte]*download)}
+}
+
+// acquire returns in-flight download of file, starting new one if
+// there is none; started is true if caller must fetch the file
+func (s *downloads) acquire(f File) (d *download, started bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.active[f.Hash]
+	if ok && d.abandoned() {
+		ok = false
+	}
+	if !ok {
+		d = newDownload(f)
+		s.active[f.Hash] = d
+	}
+	d.mu.Lock()
+	d.refs++
+	d.mu.Unlock()
+	return d, !ok
+}
+
+// remove removes download of file from set, if it was not replaced
+func (s *downloads) remove(f File, d *download) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active[f.Hash] == d {
+		delete(s.active, f.Hash)
+	}
+}
+
+// len returns count of in-flight downloads
+func (s *downloads) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.active)
+}
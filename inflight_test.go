@@ -0,0 +1,323 @@
+package hath
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// upstreamClient responds OK to rpc actions and counts them,
+// other requests are passed to real http client
+type upstreamClient struct {
+	mu      sync.Mutex
+	actions map[string]int
+}
+
+func (c *upstreamClient) Get(u string) (*http.Response, error) {
+	req, err := http.NewRequest(httpGET, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
+
+func (c *upstreamClient) Do(req *http.Request) (*http.Response, error) {
+	action := req.URL.Query().Get(argAction)
+	if len(action) == 0 {
+		return http.DefaultClient.Do(req)
+	}
+	c.mu.Lock()
+	c.actions[action]++
+	c.mu.Unlock()
+	body := bytes.NewBufferString("OK")
+	if action == actionTokens {
+		// issuing token for every requested file
+		for _, id := range strings.Split(req.URL.Query().Get(argActionArgument), argsDelimiter) {
+			if len(id) != 0 {
+				fmt.Fprintf(body, "\n%s%stoken", id, tokenDelimiter)
+			}
+		}
+	}
+	r := new(http.Response)
+	r.StatusCode = http.StatusOK
+	r.Body = ioutil.NopCloser(body)
+	return r, nil
+}
+
+func (c *upstreamClient) calls(action string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.actions[action]
+}
+
+func TestDownload(t *testing.T) {
+	Convey("Download", t, func() {
+		f := File{Size: 6}
+		d := newDownload(f)
+		r := d.NewReader(context.Background())
+		result := make(chan []byte)
+		go func() {
+			data, _ := ioutil.ReadAll(r)
+			result <- data
+		}()
+		d.Write([]byte("foo"))
+		So(d.wait(context.Background()), ShouldBeNil)
+		d.Write([]byte("bar"))
+		d.finish(nil)
+		So(string(<-result), ShouldEqual, "foobar")
+		data, err := ioutil.ReadAll(d.NewReader(context.Background()))
+		So(err, ShouldBeNil)
+		So(string(data), ShouldEqual, "foobar")
+
+		Convey("Failed", func() {
+			d := newDownload(f)
+			d.Write([]byte("foo"))
+			d.finish(io.ErrUnexpectedEOF)
+			So(d.wait(context.Background()), ShouldBeNil)
+			_, err := ioutil.ReadAll(d.NewReader(context.Background()))
+			So(err, ShouldEqual, io.ErrUnexpectedEOF)
+			d = newDownload(f)
+			d.finish(ErrDownloadFailed)
+			So(d.wait(context.Background()), ShouldEqual, ErrDownloadFailed)
+		})
+		Convey("Canceled", func() {
+			d := newDownload(f)
+			ctx, cancel := context.WithCancel(context.Background())
+			waited := make(chan error, 1)
+			go func() {
+				waited <- d.wait(ctx)
+			}()
+			cancel()
+			So(<-waited, ShouldEqual, context.Canceled)
+
+			d.Write([]byte("foo"))
+			ctx, cancel = context.WithCancel(context.Background())
+			go func() {
+				_, err := ioutil.ReadAll(d.NewReader(ctx))
+				waited <- err
+			}()
+			time.Sleep(time.Millisecond * 10)
+			cancel()
+			So(<-waited, ShouldEqual, context.Canceled)
+		})
+		Convey("Set", func() {
+			s := newDownloads()
+			first, started := s.acquire(f)
+			So(started, ShouldBeTrue)
+			second, started := s.acquire(f)
+			So(started, ShouldBeFalse)
+			So(second, ShouldEqual, first)
+			So(s.len(), ShouldEqual, 1)
+			first.leave()
+			So(first.ctx.Err(), ShouldBeNil)
+			second.leave()
+			So(first.ctx.Err(), ShouldNotBeNil)
+
+			// abandoned download is replaced
+			third, started := s.acquire(f)
+			So(started, ShouldBeTrue)
+			So(third, ShouldNotEqual, first)
+			s.remove(f, first)
+			So(s.len(), ShouldEqual, 1)
+			s.remove(f, third)
+			So(s.len(), ShouldEqual, 0)
+		})
+	})
+}
+
+// proxyServer is server that proxies files from upstream handler
+type proxyServer struct {
+	*DefaultServer
+	api *upstreamClient
+	db  DataBase
+	url string
+	// upstream is host of upstream server
+	upstream string
+	dir      string
+}
+
+func newProxyServer(upstream http.Handler, options ...func(*ServerConfig)) (*proxyServer, func()) {
+	up := httptest.NewServer(upstream)
+	upstreamURL, err := url.Parse(up.URL)
+	So(err, ShouldBeNil)
+	testDir, err := ioutil.TempDir("", randDirPrefix)
+	So(err, ShouldBeNil)
+	db, err := NewDB(path.Join(testDir, "bolt.db"))
+	So(err, ShouldBeNil)
+	api := &upstreamClient{actions: make(map[string]int)}
+	c := NewClient(ClientConfig{})
+	c.httpClient = api
+	cfg := ServerConfig{}
+	cfg.Client = c
+	cfg.DataBase = db
+	cfg.Frontend = NewFrontend(testDir)
+	cfg.UpdateRate = time.Millisecond * 10
+	cfg.Settings.ProxyMode = ProxyAllNetworksOpen
+	cfg.Settings.RequestServer = upstreamURL.Host
+	for _, option := range options {
+		option(&cfg)
+	}
+	server := NewServer(cfg)
+	server.headlessStart = true
+	So(server.Start(), ShouldBeNil)
+	ts := httptest.NewUnstartedServer(server)
+	ts.Config.ConnContext = server.connContext
+	ts.Start()
+	return &proxyServer{server, api, db, ts.URL, upstreamURL.Host, testDir}, func() {
+		ts.Close()
+		server.Close()
+		up.Close()
+		os.RemoveAll(testDir)
+	}
+}
+
+// fileURL returns url of proxy request of file
+func (s *proxyServer) fileURL(f File) string {
+	return fmt.Sprintf("%s/p/fileid=%s;token=token;gid=1;page=1/%s.jpg", s.url, f, f.HexID())
+}
+
+// waitDownloads waits until all in-flight downloads are completed
+func (s *proxyServer) waitDownloads() {
+	deadline := time.Now().Add(time.Second * 2)
+	for s.downloads.len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	So(s.downloads.len(), ShouldEqual, 0)
+}
+
+// randomFile returns random file info with its content
+func randomFile(size int) (File, []byte) {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	So(err, ShouldBeNil)
+	return File{Hash: sha1.Sum(data), Type: JPG, Size: int64(size), Width: 100, Height: 100}, data
+}
+
+func TestProxyDeduplication(t *testing.T) {
+	Convey("Concurrent proxy requests", t, func() {
+		f, data := randomFile(4096)
+		var requests int32
+		release := make(chan struct{})
+		server, cleanup := newProxyServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.Write(data[:1024])
+			w.(http.Flusher).Flush()
+			<-release
+			w.Write(data[1024:])
+		}))
+		defer cleanup()
+
+		const count = 5
+		results := make(chan []byte, count)
+		for i := 0; i < count; i++ {
+			go func() {
+				res, err := http.Get(server.fileURL(f))
+				if err != nil {
+					results <- nil
+					return
+				}
+				defer res.Body.Close()
+				body, _ := ioutil.ReadAll(res.Body)
+				results <- body
+			}()
+		}
+		joined := func() bool {
+			server.downloads.mu.Lock()
+			defer server.downloads.mu.Unlock()
+			for _, d := range server.downloads.active {
+				d.mu.Lock()
+				defer d.mu.Unlock()
+				return d.refs == count
+			}
+			return false
+		}
+		deadline := time.Now().Add(time.Second * 2)
+		for !joined() && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 5)
+		}
+		So(joined(), ShouldBeTrue)
+		close(release)
+		for i := 0; i < count; i++ {
+			So(<-results, ShouldResemble, data)
+		}
+		So(atomic.LoadInt32(&requests), ShouldEqual, 1)
+		server.waitDownloads()
+		So(server.db.Exists(f), ShouldBeTrue)
+		So(server.Close(), ShouldBeNil)
+		So(server.api.calls(actionFileAdd), ShouldEqual, 1)
+	})
+}
+
+func TestProxyVerification(t *testing.T) {
+	Convey("Proxy verification", t, func() {
+		f, data := randomFile(4096)
+		Convey("Retry on bad status", func() {
+			var requests int32
+			server, cleanup := newProxyServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				if r.URL.Query().Get("nl") != "1" {
+					http.NotFound(w, r)
+					return
+				}
+				w.Write(data)
+			}))
+			defer cleanup()
+			res, err := http.Get(server.fileURL(f))
+			So(err, ShouldBeNil)
+			defer res.Body.Close()
+			So(res.StatusCode, ShouldEqual, http.StatusOK)
+			body, err := ioutil.ReadAll(res.Body)
+			So(err, ShouldBeNil)
+			So(body, ShouldResemble, data)
+			So(atomic.LoadInt32(&requests), ShouldEqual, server.cfg.MaxDownloadAttemps)
+			server.waitDownloads()
+			So(server.db.Exists(f), ShouldBeTrue)
+		})
+		Convey("Bad hash", func() {
+			server, cleanup := newProxyServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				corrupted := append([]byte{}, data...)
+				corrupted[len(corrupted)-1] ^= 0xff
+				w.Write(corrupted[:1024])
+				w.(http.Flusher).Flush()
+				// letting user receive first bytes
+				time.Sleep(time.Millisecond * 50)
+				w.Write(corrupted[1024:])
+			}))
+			defer cleanup()
+			res, err := http.Get(server.fileURL(f))
+			So(err, ShouldBeNil)
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			// connection is aborted before last byte was sent
+			So(err, ShouldNotBeNil)
+			So(len(body), ShouldBeLessThan, len(data))
+			server.waitDownloads()
+			So(server.db.Exists(f), ShouldBeFalse)
+		})
+		Convey("Failed", func() {
+			server, cleanup := newProxyServer(http.NotFoundHandler())
+			defer cleanup()
+			res, err := http.Get(server.fileURL(f))
+			So(err, ShouldBeNil)
+			res.Body.Close()
+			So(res.StatusCode, ShouldEqual, http.StatusInternalServerError)
+			server.waitDownloads()
+		})
+	})
+}
@@ -0,0 +1,218 @@
+package hath
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServerState is state of server lifecycle
+type ServerState byte
+
+const (
+	// StateNew is state of server that is not started yet
+	StateNew ServerState = iota
+	// StateRunning is normal state, files are served
+	StateRunning
+	// StateSuspending is state when rpc server is being notified
+	// of suspend, files are still served
+	StateSuspending
+	// StateSuspended is state when rpc server is notified
+	// of suspend and new files requests are not served
+	StateSuspended
+	// StateResuming is state when rpc server is being notified
+	// of resume, files are not served yet
+	StateResuming
+	// StateStopping is state of server shutdown
+	StateStopping
+)
+
+func (s ServerState) String() string {
+	switch s {
+	case StateNew:
+		return "new"
+	case StateRunning:
+		return "running"
+	case StateSuspending:
+		return "suspending"
+	case StateSuspended:
+		return "suspended"
+	case StateResuming:
+		return "resuming"
+	case StateStopping:
+		return "stopping"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (s ServerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+var (
+	// ErrNotRunning is returned when server should be running
+	ErrNotRunning = errors.New("Server is not running")
+	// ErrNotSuspended is returned when server should be suspended
+	ErrNotSuspended = errors.New("Server is not suspended")
+)
+
+// State returns current lifecycle state of server
+func (s *DefaultServer) State() ServerState {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.state
+}
+
+// Suspend notifies rpc server of suspend and stops serving
+// new file requests; if d is positive, server will be
+// resumed automatically after d
+func (s *DefaultServer) Suspend(d time.Duration) error {
+	s.stateLock.Lock()
+	if s.state != StateRunning {
+		s.stateLock.Unlock()
+		return ErrNotRunning
+	}
+	s.state = StateSuspending
+	s.stateLock.Unlock()
+
+	// lock is not held during notification, so
+	// files are served while rpc server is notified
+	err := s.api.Suspend()
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	if s.state != StateSuspending {
+		// server was stopped during notification
+		return ErrNotRunning
+	}
+	if err != nil {
+		s.state = StateRunning
+		log.Println("server:", "suspend notification failed:", err)
+		return err
+	}
+	s.state = StateSuspended
+	if d > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(d, func() {
+			s.stateLock.Lock()
+			// timer can fire concurrently with manual resume
+			// or stop, then it is not current anymore
+			current := s.resumeTimer == timer && s.state == StateSuspended
+			if current {
+				s.state = StateResuming
+			}
+			s.stateLock.Unlock()
+			if !current {
+				return
+			}
+			log.Println("server:", "resuming after", d)
+			if err := s.notifyResume(); err != nil {
+				log.Println("server:", "auto resume failed:", err)
+			}
+		})
+		s.resumeTimer = timer
+		log.Println("server:", "suspended for", d)
+	} else {
+		log.Println("server:", "suspended")
+	}
+	return nil
+}
+
+// Resume notifies rpc server of resume and continues
+// serving file requests
+func (s *DefaultServer) Resume() error {
+	s.stateLock.Lock()
+	if s.state != StateSuspended {
+		s.stateLock.Unlock()
+		return ErrNotSuspended
+	}
+	s.state = StateResuming
+	s.stateLock.Unlock()
+	return s.notifyResume()
+}
+
+// notifyResume notifies rpc server of resume and switches
+// server from resuming state to running or back to suspended
+func (s *DefaultServer) notifyResume() error {
+	err := s.api.Resume()
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	if s.state != StateResuming {
+		// server was stopped during notification
+		return ErrNotSuspended
+	}
+	if err != nil {
+		s.state = StateSuspended
+		log.Println("server:", "resume notification failed:", err)
+		return err
+	}
+	s.stopResumeTimer()
+	s.state = StateRunning
+	log.Println("server:", "resumed")
+	return nil
+}
+
+// stopResumeTimer cancels automatic resume, should be called with stateLock held
+func (s *DefaultServer) stopResumeTimer() {
+	if s.resumeTimer != nil {
+		s.resumeTimer.Stop()
+		s.resumeTimer = nil
+	}
+}
+
+// setStopping switches server to stopping state
+func (s *DefaultServer) setStopping() {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	s.stopResumeTimer()
+	s.state = StateStopping
+}
+
+// checkRunning responds with 503 if server is not running
+// and is not being suspended
+func (s *DefaultServer) checkRunning(c *gin.Context) {
+	if state := s.State(); state != StateRunning && state != StateSuspending {
+		c.String(http.StatusServiceUnavailable, "503: server is "+state.String())
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// handleAdminState returns current state
+// GET /api/admin/state
+func (s *DefaultServer) handleAdminState(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"state": s.State()})
+}
+
+// handleAdminSuspend suspends server
+// POST /api/admin/suspend?duration=<duration>
+func (s *DefaultServer) handleAdminSuspend(c *gin.Context) {
+	var d time.Duration
+	if duration := c.Query("duration"); len(duration) != 0 {
+		var err error
+		if d, err = time.ParseDuration(duration); err != nil {
+			c.String(http.StatusBadRequest, "400: bad duration")
+			return
+		}
+	}
+	if err := s.Suspend(d); err != nil {
+		c.String(http.StatusConflict, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"state": s.State()})
+}
+
+// handleAdminResume resumes server
+// POST /api/admin/resume
+func (s *DefaultServer) handleAdminResume(c *gin.Context) {
+	if err := s.Resume(); err != nil {
+		c.String(http.StatusConflict, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"state": s.State()})
+}
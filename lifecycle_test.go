@@ -0,0 +1,175 @@
+package hath
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// stubClient responds with same body to every request
+type stubClient struct {
+	body string
+	err  error
+}
+
+func (s stubClient) response() *http.Response {
+	r := new(http.Response)
+	r.StatusCode = http.StatusOK
+	r.Body = ioutil.NopCloser(bytes.NewBufferString(s.body))
+	return r
+}
+
+func (s stubClient) Get(url string) (*http.Response, error) {
+	return s.response(), s.err
+}
+
+func (s stubClient) Do(req *http.Request) (*http.Response, error) {
+	return s.response(), s.err
+}
+
+// releasedClient responds with OK after release is closed
+type releasedClient struct {
+	release chan struct{}
+}
+
+func (b releasedClient) Get(url string) (*http.Response, error) {
+	<-b.release
+	return stubClient{body: "OK"}.Get(url)
+}
+
+func (b releasedClient) Do(req *http.Request) (*http.Response, error) {
+	<-b.release
+	return stubClient{body: "OK"}.Do(req)
+}
+
+func TestLifecycle(t *testing.T) {
+	Convey("Lifecycle", t, func() {
+		testDir, err := ioutil.TempDir("", randDirPrefix)
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(testDir)
+		db, err := NewDB(path.Join(testDir, "bolt.db"))
+		So(err, ShouldBeNil)
+
+		c := NewClient(ClientConfig{})
+		c.httpClient = stubClient{body: "OK"}
+		cfg := ServerConfig{}
+		cfg.Client = c
+		cfg.DataBase = db
+		cfg.Frontend = NewFrontend(testDir)
+		server := NewServer(cfg)
+		server.headlessStart = true
+		So(server.State(), ShouldEqual, StateNew)
+		So(server.Suspend(0), ShouldEqual, ErrNotRunning)
+		So(server.Start(), ShouldBeNil)
+		defer server.Close()
+		So(server.State(), ShouldEqual, StateRunning)
+
+		request := func(method, url string) int {
+			req, err := http.NewRequest(method, url, nil)
+			So(err, ShouldBeNil)
+			req.RemoteAddr = "127.0.0.1:1234"
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			return rec.Code
+		}
+		imageURL := "/h/070b45ae488fb1967aaf618561a7d6ba4d28a1c9-12345-1920-1080-png/keystamp=1-a/test.png"
+
+		Convey("Suspend", func() {
+			So(server.Suspend(0), ShouldBeNil)
+			So(server.State(), ShouldEqual, StateSuspended)
+			So(server.Suspend(0), ShouldEqual, ErrNotRunning)
+			So(request(httpGET, imageURL), ShouldEqual, http.StatusServiceUnavailable)
+			Convey("Resume", func() {
+				So(server.Resume(), ShouldBeNil)
+				So(server.State(), ShouldEqual, StateRunning)
+				So(server.Resume(), ShouldEqual, ErrNotSuspended)
+				So(request(httpGET, imageURL), ShouldNotEqual, http.StatusServiceUnavailable)
+			})
+		})
+		Convey("Auto resume", func() {
+			So(server.Suspend(time.Millisecond*10), ShouldBeNil)
+			So(server.State(), ShouldEqual, StateSuspended)
+			time.Sleep(time.Millisecond * 50)
+			So(server.State(), ShouldEqual, StateRunning)
+		})
+		Convey("Slow notification", func() {
+			release := make(chan struct{})
+			server.api.httpClient = releasedClient{release}
+			done := make(chan error, 1)
+			go func() {
+				done <- server.Suspend(0)
+			}()
+			deadline := time.Now().Add(time.Second)
+			for server.State() != StateSuspending && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			So(server.State(), ShouldEqual, StateSuspending)
+			So(server.Suspend(0), ShouldEqual, ErrNotRunning)
+			So(request(httpGET, imageURL), ShouldNotEqual, http.StatusServiceUnavailable)
+			close(release)
+			So(<-done, ShouldBeNil)
+			So(server.State(), ShouldEqual, StateSuspended)
+		})
+		Convey("Resume before timer", func() {
+			So(server.Suspend(time.Millisecond*10), ShouldBeNil)
+			So(server.Resume(), ShouldBeNil)
+			So(server.Suspend(time.Hour), ShouldBeNil)
+			time.Sleep(time.Millisecond * 50)
+			So(server.State(), ShouldEqual, StateSuspended)
+		})
+		Convey("Notification failure", func() {
+			server.api.httpClient = stubClient{body: "FAIL"}
+			So(server.Suspend(0), ShouldNotBeNil)
+			So(server.State(), ShouldEqual, StateRunning)
+		})
+		Convey("Graceful shutdown", func() {
+			done := make(chan error, 1)
+			go func() {
+				done <- server.Listen()
+			}()
+			// waiting for listener
+			time.Sleep(time.Millisecond * 50)
+			f := File{Type: PNG}
+			server.useQuery <- f
+			server.registerQuery <- f
+			So(server.Close(), ShouldBeNil)
+			So(server.State(), ShouldEqual, StateStopping)
+			So(len(server.useQuery), ShouldEqual, 0)
+
+			// producers are not blocked after stop
+			queued := make(chan bool)
+			go func() {
+				server.use(f)
+				server.register(f)
+				close(queued)
+			}()
+			select {
+			case <-queued:
+			case <-time.After(time.Second):
+				So("producer is blocked", ShouldBeEmpty)
+			}
+			select {
+			case err := <-done:
+				So(err, ShouldBeNil)
+			case <-time.After(time.Second):
+				So("listener is not stopped", ShouldBeEmpty)
+			}
+		})
+		Convey("Admin", func() {
+			So(request("POST", "/api/admin/suspend?duration=1h"), ShouldEqual, http.StatusOK)
+			So(server.State(), ShouldEqual, StateSuspended)
+			So(request(httpGET, "/api/admin/state"), ShouldEqual, http.StatusOK)
+			So(request("POST", "/api/admin/suspend"), ShouldEqual, http.StatusConflict)
+			So(request("POST", "/api/admin/resume"), ShouldEqual, http.StatusOK)
+			So(server.State(), ShouldEqual, StateRunning)
+			So(request("POST", "/api/admin/suspend?duration=bad"), ShouldEqual, http.StatusBadRequest)
+		})
+	})
+}
@@ -0,0 +1,210 @@
+package hath
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// loadLatencyWeight is weight of new sample in moving average of latency
+	loadLatencyWeight = 0.1
+	// loadHighFactor is part of threshold, after which load is high
+	loadHighFactor = 0.8
+)
+
+// LoadLevel is level of server load
+type LoadLevel byte
+
+const (
+	// LoadNormal is normal load
+	LoadNormal LoadLevel = iota
+	// LoadHigh is load that is close to threshold
+	LoadHigh
+	// LoadOverloaded is load above threshold
+	LoadOverloaded
+)
+
+func (l LoadLevel) String() string {
+	switch l {
+	case LoadNormal:
+		return "normal"
+	case LoadHigh:
+		return "high"
+	case LoadOverloaded:
+		return "overloaded"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (l LoadLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// Load is snapshot of server load
+type Load struct {
+	Connections    int64         `json:"connections"`
+	BytesPerSecond int64         `json:"bytes_per_second"`
+	UsageQueue     int           `json:"usage_queue"`
+	Latency        time.Duration `json:"latency"`
+	// Factor is maximum ratio of load parameters to their limits
+	Factor float64   `json:"factor"`
+	Level  LoadLevel `json:"level"`
+}
+
+// OverloadConfig is limits for load parameters,
+// zero values disable corresponding check
+type OverloadConfig struct {
+	MaxConnections int64
+	MaxLatency     time.Duration
+	// MaxUsageQueue is maximum count of pending
+	// updates of last usage of files
+	MaxUsageQueue int
+	// Threshold is part of maximum bandwidth (Settings.MaximumBytesPerSecond)
+	// and other limits after which server is overloaded
+	Threshold float64
+	// NotifyInterval is minimum interval between overload notifications
+	NotifyInterval time.Duration
+}
+
+// loadMonitor collects load parameters of server
+type loadMonitor struct {
+	connections int64 // atomic
+	bytes       int64 // atomic, bytes sent since last measure
+
+	mu          sync.Mutex
+	latency     float64 // moving average in nanoseconds
+	lastMeasure time.Time
+	lastNotify  time.Time
+}
+
+func newLoadMonitor() *loadMonitor {
+	return &loadMonitor{lastMeasure: time.Now()}
+}
+
+// begin registers new connection
+func (m *loadMonitor) begin() {
+	atomic.AddInt64(&m.connections, 1)
+}
+
+// sent registers bytes sent to connection
+func (m *loadMonitor) sent(n int) {
+	atomic.AddInt64(&m.bytes, int64(n))
+}
+
+// end unregisters connection with latency of response
+func (m *loadMonitor) end(duration time.Duration) {
+	atomic.AddInt64(&m.connections, -1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.latency == 0 {
+		m.latency = float64(duration)
+	} else {
+		m.latency += (float64(duration) - m.latency) * loadLatencyWeight
+	}
+}
+
+// measure returns load since last measure
+func (m *loadMonitor) measure(now time.Time, usageQueue int, maxBytesPerSecond int64, cfg OverloadConfig) (l Load) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elapsed := now.Sub(m.lastMeasure).Seconds()
+	m.lastMeasure = now
+	bytes := atomic.SwapInt64(&m.bytes, 0)
+	if elapsed > 0 {
+		l.BytesPerSecond = int64(float64(bytes) / elapsed)
+	}
+	l.Connections = atomic.LoadInt64(&m.connections)
+	l.Latency = time.Duration(m.latency)
+	l.UsageQueue = usageQueue
+
+	factor := func(value, limit float64) {
+		if limit <= 0 {
+			return
+		}
+		if f := value / (limit * cfg.Threshold); f > l.Factor {
+			l.Factor = f
+		}
+	}
+	factor(float64(l.Connections), float64(cfg.MaxConnections))
+	factor(float64(l.BytesPerSecond), float64(maxBytesPerSecond))
+	factor(float64(l.UsageQueue), float64(cfg.MaxUsageQueue))
+	factor(float64(l.Latency), float64(cfg.MaxLatency))
+
+	switch {
+	case l.Factor >= 1:
+		l.Level = LoadOverloaded
+	case l.Factor >= loadHighFactor:
+		l.Level = LoadHigh
+	}
+	return l
+}
+
+// shouldNotify returns true if notification was not sent for interval
+func (m *loadMonitor) shouldNotify(now time.Time, interval time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.lastNotify) < interval {
+		return false
+	}
+	m.lastNotify = now
+	return true
+}
+
+// loadResponseWriter counts bytes sent in load monitor
+// and remembers time of first write of body
+type loadResponseWriter struct {
+	gin.ResponseWriter
+	m     *loadMonitor
+	first time.Time
+}
+
+func (w *loadResponseWriter) Write(b []byte) (int, error) {
+	if w.first.IsZero() {
+		w.first = time.Now()
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.m.sent(n)
+	return n, err
+}
+
+func (w *loadResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// trackLoad registers request in load monitor; latency is
+// time to first byte of body, so throttled transfer of
+// large files is not treated as overload
+func (s *DefaultServer) trackLoad(c *gin.Context) {
+	start := time.Now()
+	s.load.begin()
+	w := &loadResponseWriter{ResponseWriter: c.Writer, m: s.load}
+	defer func() {
+		latency := time.Since(start)
+		if !w.first.IsZero() {
+			latency = w.first.Sub(start)
+		}
+		s.load.end(latency)
+	}()
+	c.Writer = w
+	c.Next()
+}
+
+// measureLoad updates current load and notifies rpc server on overload
+func (s *DefaultServer) measureLoad(now time.Time) Load {
+	l := s.load.measure(now, len(s.useQuery), s.limiter.Rate(), s.cfg.Overload)
+	if l.Level == LoadOverloaded && s.load.shouldNotify(now, s.cfg.Overload.NotifyInterval) {
+		log.Println("server:", "overloaded:", l.Factor)
+		go func() {
+			if err := s.api.Overload(); err != nil {
+				log.Println("server:", "overload notification failed:", err)
+			}
+		}()
+	}
+	return l
+}
@@ -0,0 +1,84 @@
+package hath
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLoadMonitor(t *testing.T) {
+	Convey("Load monitor", t, func() {
+		cfg := OverloadConfig{
+			MaxConnections: 10,
+			MaxUsageQueue:  100,
+			MaxLatency:     time.Second,
+			Threshold:      1,
+		}
+		m := newLoadMonitor()
+		start := m.lastMeasure
+		Convey("Normal", func() {
+			m.begin()
+			m.sent(100)
+			l := m.measure(start.Add(time.Second), 0, 1000, cfg)
+			So(l.Connections, ShouldEqual, 1)
+			So(l.BytesPerSecond, ShouldEqual, 100)
+			So(l.Level, ShouldEqual, LoadNormal)
+			Convey("Bytes are reset", func() {
+				l := m.measure(start.Add(time.Second*2), 0, 1000, cfg)
+				So(l.BytesPerSecond, ShouldEqual, 0)
+			})
+		})
+		Convey("Bandwidth", func() {
+			m.sent(900)
+			l := m.measure(start.Add(time.Second), 0, 1000, cfg)
+			So(l.Level, ShouldEqual, LoadHigh)
+			m.sent(1500)
+			l = m.measure(start.Add(time.Second*2), 0, 1000, cfg)
+			So(l.Level, ShouldEqual, LoadOverloaded)
+			So(l.Level.String(), ShouldEqual, "overloaded")
+		})
+		Convey("Connections", func() {
+			for i := 0; i < 10; i++ {
+				m.begin()
+			}
+			l := m.measure(start.Add(time.Second), 0, 0, cfg)
+			So(l.Level, ShouldEqual, LoadOverloaded)
+			for i := 0; i < 10; i++ {
+				m.end(time.Millisecond)
+			}
+			l = m.measure(start.Add(time.Second*2), 0, 0, cfg)
+			So(l.Level, ShouldEqual, LoadNormal)
+			So(l.Latency, ShouldEqual, time.Millisecond)
+		})
+		Convey("Usage queue", func() {
+			l := m.measure(start.Add(time.Second), 150, 0, cfg)
+			So(l.Level, ShouldEqual, LoadOverloaded)
+			So(l.Factor, ShouldAlmostEqual, 1.5)
+		})
+		Convey("Time to first byte", func() {
+			gin.SetMode(gin.TestMode)
+			s := &DefaultServer{load: m}
+			e := gin.New()
+			e.GET("/", s.trackLoad, func(c *gin.Context) {
+				c.Writer.Write([]byte("first"))
+				// slow transfer of body is not latency
+				time.Sleep(time.Millisecond * 50)
+				c.Writer.Write([]byte("last"))
+			})
+			e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(httpGET, "/", nil))
+			l := m.measure(start.Add(time.Second), 0, 0, cfg)
+			So(l.Latency, ShouldBeLessThan, time.Millisecond*50)
+			So(l.BytesPerSecond, ShouldEqual, 9)
+			So(l.Connections, ShouldEqual, 0)
+		})
+		Convey("Notification interval", func() {
+			now := time.Now()
+			So(m.shouldNotify(now, time.Minute), ShouldBeTrue)
+			So(m.shouldNotify(now.Add(time.Second), time.Minute), ShouldBeFalse)
+			So(m.shouldNotify(now.Add(time.Minute), time.Minute), ShouldBeTrue)
+		})
+	})
+}
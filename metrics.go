@@ -0,0 +1,342 @@
+package hath
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+	// metricsTokenArg is query argument with metrics token
+	metricsTokenArg = "token"
+)
+
+var (
+	// durationBuckets are histogram buckets for durations in seconds
+	durationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	// sizeBuckets are histogram buckets for sizes in bytes
+	sizeBuckets = []float64{1 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+	// metricRoutes are known first segments of request path,
+	// other paths are reported as "other" to limit label values
+	metricRoutes = map[string]bool{
+		"h": true, "p": true, "t": true, "servercmd": true,
+		"api": true, "metrics": true, "favicon.ico": true, "robots.txt": true,
+	}
+)
+
+// metricSeries is value of metric with concrete label values
+type metricSeries struct {
+	labels []string
+	value  float64
+	// histogram only
+	counts []uint64
+	count  uint64
+}
+
+// metricFamily is metric with all its series
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+// Metrics collects counters, gauges and histograms
+// and exposes them in prometheus text format
+type Metrics struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+// NewMetrics creates metrics with all server metrics registered
+func NewMetrics() *Metrics {
+	m := &Metrics{families: make(map[string]*metricFamily)}
+	m.register("hath_requests_total", "Count of handled requests.", metricCounter, nil, "route", "status")
+	m.register("hath_request_duration_seconds", "Duration of handled requests.", metricHistogram, durationBuckets, "route")
+	m.register("hath_sent_bytes_total", "Bytes sent in responses.", metricCounter, nil, "route")
+	m.register("hath_response_size_bytes", "Size of response bodies.", metricHistogram, sizeBuckets, "route")
+	m.register("hath_received_bytes_total", "Bytes of files received from hath network.", metricCounter, nil)
+	m.register("hath_received_file_size_bytes", "Size of files received from hath network.", metricHistogram, sizeBuckets)
+	m.register("hath_keystamp_failures_total", "Count of requests with bad keystamp.", metricCounter, nil)
+	m.register("hath_proxy_attempts_total", "Count of proxy download attempts.", metricCounter, nil, "source")
+	m.register("hath_proxy_fallbacks_total", "Count of proxy fallbacks to direct download.", metricCounter, nil)
+	m.register("hath_rpc_duration_seconds", "Duration of rpc calls including retries.", metricHistogram, durationBuckets, "action")
+	m.register("hath_rpc_errors_total", "Count of failed rpc calls.", metricCounter, nil, "action")
+	m.register("hath_db_duration_seconds", "Duration of database operations.", metricHistogram, durationBuckets, "operation")
+	m.register("hath_evictions_total", "Count of files removed from cache.", metricCounter, nil)
+	m.register("hath_cache_size_bytes", "Total size of cached files.", metricGauge, nil)
+	m.register("hath_cache_files", "Count of cached files.", metricGauge, nil)
+	return m
+}
+
+func (m *Metrics) register(name, help, kind string, buckets []float64, labels ...string) {
+	m.families[name] = &metricFamily{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*metricSeries),
+	}
+}
+
+// get returns series of metric, creating it if needed;
+// m.mu should be locked
+func (m *Metrics) get(name string, labels []string) (*metricFamily, *metricSeries) {
+	family, ok := m.families[name]
+	if !ok || len(labels) != len(family.labels) {
+		panic("hath: bad metric " + name)
+	}
+	key := strings.Join(labels, "\xff")
+	s, ok := family.series[key]
+	if !ok {
+		s = &metricSeries{labels: labels}
+		if family.kind == metricHistogram {
+			s.counts = make([]uint64, len(family.buckets))
+		}
+		family.series[key] = s
+	}
+	return family, s
+}
+
+// Add increases counter by v
+func (m *Metrics) Add(name string, v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, s := m.get(name, labels)
+	s.value += v
+}
+
+// Set sets value of gauge
+func (m *Metrics) Set(name string, v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, s := m.get(name, labels)
+	s.value = v
+}
+
+// Observe adds value to histogram
+func (m *Metrics) Observe(name string, v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	family, s := m.get(name, labels)
+	for i, bound := range family.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// Since adds duration from start to histogram in seconds
+func (m *Metrics) Since(name string, start time.Time, labels ...string) {
+	m.Observe(name, time.Since(start).Seconds(), labels...)
+}
+
+// Expose writes all metrics in prometheus text format
+func (m *Metrics) Expose(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := bufio.NewWriter(w)
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := m.families[name]
+		fmt.Fprintf(b, "# HELP %s %s\n", name, family.help)
+		fmt.Fprintf(b, "# TYPE %s %s\n", name, family.kind)
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := family.series[key]
+			if family.kind != metricHistogram {
+				fmt.Fprintf(b, "%s%s %s\n", name, formatLabels(family.labels, s.labels), formatValue(s.value))
+				continue
+			}
+			bucketNames := append(append([]string{}, family.labels...), "le")
+			for i, bound := range family.buckets {
+				labels := formatLabels(bucketNames, append(append([]string{}, s.labels...), formatValue(bound)))
+				fmt.Fprintf(b, "%s_bucket%s %d\n", name, labels, s.counts[i])
+			}
+			labels := formatLabels(bucketNames, append(append([]string{}, s.labels...), "+Inf"))
+			fmt.Fprintf(b, "%s_bucket%s %d\n", name, labels, s.count)
+			fmt.Fprintf(b, "%s_sum%s %s\n", name, formatLabels(family.labels, s.labels), formatValue(s.value))
+			fmt.Fprintf(b, "%s_count%s %d\n", name, formatLabels(family.labels, s.labels), s.count)
+		}
+	}
+	return b.Flush()
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricRoute returns route label of request path
+func metricRoute(path string) string {
+	elems := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if metricRoutes[elems[0]] {
+		return elems[0]
+	}
+	return "other"
+}
+
+// instrument records metrics of request
+func (s *DefaultServer) instrument(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	route := metricRoute(c.Request.URL.Path)
+	size := c.Writer.Size()
+	if size < 0 {
+		size = 0
+	}
+	s.metrics.Add("hath_requests_total", 1, route, strconv.Itoa(c.Writer.Status()))
+	s.metrics.Since("hath_request_duration_seconds", start, route)
+	s.metrics.Add("hath_sent_bytes_total", float64(size), route)
+	s.metrics.Observe("hath_response_size_bytes", float64(size), route)
+}
+
+// metricsAuth allows requests from local networks or with
+// valid MetricsToken in query or bearer authorization header
+func (s *DefaultServer) metricsAuth(c *gin.Context) {
+	if len(s.cfg.MetricsToken) == 0 {
+		localOnly(c)
+		return
+	}
+	token := c.Query(metricsTokenArg)
+	if auth := c.Request.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token != s.cfg.MetricsToken {
+		localOnly(c)
+		return
+	}
+	c.Next()
+}
+
+// handleMetrics returns metrics in prometheus text format
+// GET /metrics
+func (s *DefaultServer) handleMetrics(c *gin.Context) {
+	// cache totals are served from statistics, because
+	// counting them in database is full scan
+	stats := s.stats.get()
+	s.metrics.Set("hath_cache_size_bytes", float64(stats.FilesTotalBytes))
+	s.metrics.Set("hath_cache_files", float64(stats.FilesTotal))
+	c.Writer.Header().Set(headerContentType, metricsContentType)
+	c.Writer.WriteHeader(http.StatusOK)
+	if err := s.metrics.Expose(c.Writer); err != nil {
+		log.Println("server:", "failed to write metrics:", err)
+	}
+}
+
+// metricsDB measures latency of database operations
+type metricsDB struct {
+	DataBase
+	metrics *Metrics
+}
+
+func (db metricsDB) Add(f File) error {
+	defer db.metrics.Since("hath_db_duration_seconds", time.Now(), "add")
+	return db.DataBase.Add(f)
+}
+
+func (db metricsDB) AddBatch(files []File) error {
+	defer db.metrics.Since("hath_db_duration_seconds", time.Now(), "add_batch")
+	return db.DataBase.AddBatch(files)
+}
+
+func (db metricsDB) Use(f File) error {
+	defer db.metrics.Since("hath_db_duration_seconds", time.Now(), "use")
+	return db.DataBase.Use(f)
+}
+
+func (db metricsDB) UseBatch(files []File) error {
+	defer db.metrics.Since("hath_db_duration_seconds", time.Now(), "use_batch")
+	return db.DataBase.UseBatch(files)
+}
+
+func (db metricsDB) Remove(f File) error {
+	defer db.metrics.Since("hath_db_duration_seconds", time.Now(), "remove")
+	return db.DataBase.Remove(f)
+}
+
+func (db metricsDB) RemoveBatch(files []File) error {
+	defer db.metrics.Since("hath_db_duration_seconds", time.Now(), "remove_batch")
+	return db.DataBase.RemoveBatch(files)
+}
+
+func (db metricsDB) Exists(f File) bool {
+	defer db.metrics.Since("hath_db_duration_seconds", time.Now(), "exists")
+	return db.DataBase.Exists(f)
+}
+
+func (db metricsDB) Get(id []byte) (File, error) {
+	defer db.metrics.Since("hath_db_duration_seconds", time.Now(), "get")
+	return db.DataBase.Get(id)
+}
+
+func (db metricsDB) GetOldFiles(maxCount int, deadline time.Time) ([]File, error) {
+	defer db.metrics.Since("hath_db_duration_seconds", time.Now(), "get_old_files")
+	return db.DataBase.GetOldFiles(maxCount, deadline)
+}
+
+// countingReadCloser adds count of read bytes to metrics on close
+type countingReadCloser struct {
+	io.ReadCloser
+	metrics *Metrics
+	n       int64
+	closed  bool
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countingReadCloser) Close() error {
+	if r.closed {
+		return r.ReadCloser.Close()
+	}
+	r.closed = true
+	r.metrics.Add("hath_received_bytes_total", float64(r.n))
+	r.metrics.Observe("hath_received_file_size_bytes", float64(r.n))
+	return r.ReadCloser.Close()
+}
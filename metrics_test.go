@@ -0,0 +1,94 @@
+package hath
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMetrics(t *testing.T) {
+	Convey("Metrics", t, func() {
+		Convey("Expose", func() {
+			m := NewMetrics()
+			m.Add("hath_requests_total", 1, "h", "200")
+			m.Add("hath_requests_total", 2, "h", "200")
+			m.Observe("hath_rpc_duration_seconds", 0.02, "still_alive")
+			m.Observe("hath_rpc_duration_seconds", 20, "still_alive")
+			m.Set("hath_cache_files", 42)
+			buf := new(strings.Builder)
+			So(m.Expose(buf), ShouldBeNil)
+			out := buf.String()
+			So(out, ShouldContainSubstring, "# TYPE hath_requests_total counter\n")
+			So(out, ShouldContainSubstring, `hath_requests_total{route="h",status="200"} 3`+"\n")
+			So(out, ShouldContainSubstring, "# TYPE hath_rpc_duration_seconds histogram\n")
+			So(out, ShouldContainSubstring, `hath_rpc_duration_seconds_bucket{action="still_alive",le="0.01"} 0`+"\n")
+			So(out, ShouldContainSubstring, `hath_rpc_duration_seconds_bucket{action="still_alive",le="0.025"} 1`+"\n")
+			So(out, ShouldContainSubstring, `hath_rpc_duration_seconds_bucket{action="still_alive",le="+Inf"} 2`+"\n")
+			So(out, ShouldContainSubstring, `hath_rpc_duration_seconds_sum{action="still_alive"} 20.02`+"\n")
+			So(out, ShouldContainSubstring, `hath_rpc_duration_seconds_count{action="still_alive"} 2`+"\n")
+			So(out, ShouldContainSubstring, "hath_cache_files 42\n")
+			So(func() { m.Add("hath_requests_total", 1) }, ShouldPanic)
+		})
+		Convey("Route", func() {
+			So(metricRoute("/h/id/kwds/file.jpg"), ShouldEqual, "h")
+			So(metricRoute("/metrics"), ShouldEqual, "metrics")
+			So(metricRoute("/wp-admin/login.php"), ShouldEqual, "other")
+		})
+		Convey("Server", func() {
+			f, data := randomFile(1024)
+			server, cleanup := newProxyServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(data)
+			}), func(cfg *ServerConfig) {
+				cfg.MetricsToken = "secret"
+			})
+			defer cleanup()
+			res, err := http.Get(server.fileURL(f))
+			So(err, ShouldBeNil)
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			So(res.StatusCode, ShouldEqual, http.StatusOK)
+			server.waitDownloads()
+
+			res, err = http.Get(server.url + "/metrics")
+			So(err, ShouldBeNil)
+			defer res.Body.Close()
+			So(res.StatusCode, ShouldEqual, http.StatusOK)
+			So(res.Header.Get(headerContentType), ShouldEqual, metricsContentType)
+			body, err := ioutil.ReadAll(res.Body)
+			So(err, ShouldBeNil)
+			out := string(body)
+			So(out, ShouldContainSubstring, `hath_requests_total{route="p",status="200"} 1`+"\n")
+			So(out, ShouldContainSubstring, `hath_sent_bytes_total{route="p"} 1024`+"\n")
+			So(out, ShouldContainSubstring, "hath_received_bytes_total 1024\n")
+			So(out, ShouldContainSubstring, `hath_proxy_attempts_total{source="hath"} 1`+"\n")
+			So(out, ShouldContainSubstring, `hath_db_duration_seconds_count{operation="exists"}`)
+			So(out, ShouldContainSubstring, "hath_cache_files 1\n")
+			So(out, ShouldContainSubstring, "hath_cache_size_bytes 1024\n")
+
+			// shared client is not modified by server
+			So(server.cfg.Client.metrics, ShouldBeNil)
+			So(server.DefaultServer.api.metrics, ShouldEqual, server.metrics)
+
+			Convey("Remote", func() {
+				get := func(u, auth string) int {
+					req := httptest.NewRequest(httpGET, u, nil)
+					req.RemoteAddr = "8.8.8.8:1234"
+					if len(auth) != 0 {
+						req.Header.Set("Authorization", auth)
+					}
+					w := httptest.NewRecorder()
+					server.ServeHTTP(w, req)
+					return w.Code
+				}
+				So(get("/metrics", ""), ShouldEqual, http.StatusForbidden)
+				So(get("/metrics?token=bad", ""), ShouldEqual, http.StatusForbidden)
+				So(get("/metrics?token=secret", ""), ShouldEqual, http.StatusOK)
+				So(get("/metrics", "Bearer secret"), ShouldEqual, http.StatusOK)
+			})
+		})
+	})
+}
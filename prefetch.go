@@ -0,0 +1,291 @@
+package hath
+
+import (
+	"context"
+	"crypto/sha1"
+	"log"
+	"sync"
+)
+
+const (
+	// prefetchIndexSize is maximum count of remembered gallery pages
+	prefetchIndexSize = 100000
+	// prefetchTrackSize is maximum count of prefetched files
+	// that are tracked for hit statistics
+	prefetchTrackSize = 10000
+)
+
+// PrefetchConfig is configuration of gallery page prefetching
+type PrefetchConfig struct {
+	// Enabled turns on prefetching of pages that follow
+	// requested page of the same gallery
+	Enabled bool
+	// Pages is count of following pages to prefetch
+	Pages int
+	// Budget is maximum count of files waiting for prefetch,
+	// pages over budget are not prefetched
+	Budget int
+	// BandwidthShare is part of download bandwidth that is
+	// available for prefetching, in range (0, 1]
+	BandwidthShare float64
+}
+
+// PrefetchStats is statistics of prefetching
+type PrefetchStats struct {
+	// Scheduled is count of files that were queued for prefetch
+	Scheduled int64
+	// Dropped is count of files that were over budget
+	Dropped int64
+	// Prefetched is count of files downloaded to cache
+	Prefetched int64
+	// Failed is count of failed prefetch downloads
+	Failed int64
+	// Hits is count of prefetched files that were requested later
+	Hits int64
+}
+
+// HitRatio returns part of prefetched files that were requested
+func (s PrefetchStats) HitRatio() float64 {
+	if s.Prefetched == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Prefetched)
+}
+
+// galleryPage is page of gallery
+type galleryPage struct {
+	gid  int
+	page int
+}
+
+// prefetchPage is file of gallery page
+type prefetchPage struct {
+	galleryPage
+	f File
+}
+
+// prefetcher remembers files of gallery pages from requests
+// and schedules download of pages that follow requested one
+type prefetcher struct {
+	cfg     PrefetchConfig
+	limiter *Limiter
+	jobs    chan []prefetchPage
+
+	mu         sync.Mutex
+	pages      map[galleryPage]File
+	pending    map[[sha1.Size]byte]bool
+	prefetched map[[sha1.Size]byte]bool
+	stats      PrefetchStats
+}
+
+// newPrefetcher creates prefetcher, rate is total download bandwidth
+// and prefetching is limited to its configured share
+func newPrefetcher(cfg PrefetchConfig, rate int64) *prefetcher {
+	p := &prefetcher{
+		cfg:        cfg,
+		limiter:    new(Limiter),
+		jobs:       make(chan []prefetchPage, cfg.Budget),
+		pages:      make(map[galleryPage]File),
+		pending:    make(map[[sha1.Size]byte]bool),
+		prefetched: make(map[[sha1.Size]byte]bool),
+	}
+	p.setRate(rate)
+	return p
+}
+
+// setRate updates prefetch bandwidth from total download bandwidth
+func (p *prefetcher) setRate(rate int64) {
+	p.limiter.SetRate(int64(float64(rate) * p.cfg.BandwidthShare))
+}
+
+// observe remembers file of gallery page and schedules
+// prefetch of following pages that are known
+func (p *prefetcher) observe(f File, gid, page int) {
+	if gid <= 0 || page <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pages) >= prefetchIndexSize {
+		p.pages = make(map[galleryPage]File)
+	}
+	p.pages[galleryPage{gid, page}] = f
+
+	var job []prefetchPage
+	for next := page + 1; next <= page+p.cfg.Pages; next++ {
+		key := galleryPage{gid, next}
+		nextFile, ok := p.pages[key]
+		if !ok || p.pending[nextFile.Hash] || p.prefetched[nextFile.Hash] {
+			continue
+		}
+		if len(p.pending) >= p.cfg.Budget {
+			p.stats.Dropped++
+			continue
+		}
+		job = append(job, prefetchPage{key, nextFile})
+	}
+	if len(job) == 0 {
+		return
+	}
+	select {
+	case p.jobs <- job:
+		for _, j := range job {
+			p.pending[j.f.Hash] = true
+		}
+		p.stats.Scheduled += int64(len(job))
+	default:
+		p.stats.Dropped += int64(len(job))
+	}
+}
+
+// complete records result of prefetch of file, err is nil
+// if file was downloaded and cached is true if it was
+// already in cache
+func (p *prefetcher) complete(f File, cached bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, f.Hash)
+	if cached {
+		return
+	}
+	if err != nil {
+		p.stats.Failed++
+		return
+	}
+	p.stats.Prefetched++
+	if len(p.prefetched) >= prefetchTrackSize {
+		p.prefetched = make(map[[sha1.Size]byte]bool)
+	}
+	p.prefetched[f.Hash] = true
+}
+
+// hit records request of file from cache
+func (p *prefetcher) hit(f File) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.prefetched[f.Hash] {
+		delete(p.prefetched, f.Hash)
+		p.stats.Hits++
+	}
+}
+
+// Stats returns copy of prefetch statistics
+func (p *prefetcher) Stats() PrefetchStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// prefetchLoop downloads scheduled gallery pages until server is stopped
+func (s *DefaultServer) prefetchLoop() {
+	defer s.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		select {
+		case job := <-s.prefetcher.jobs:
+			// prefetch registers files, so it is waited like other
+			// background tasks on Close, new jobs are not started
+			// after Close began waiting for them
+			s.stateLock.Lock()
+			stopping := s.state == StateStopping
+			if !stopping {
+				s.tasks.Add(1)
+			}
+			s.stateLock.Unlock()
+			if stopping {
+				continue
+			}
+			s.prefetchPages(ctx, job)
+			s.tasks.Done()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// prefetchPages requests tokens for pages that are not
+// in cache and downloads them
+func (s *DefaultServer) prefetchPages(ctx context.Context, job []prefetchPage) {
+	var (
+		missing []prefetchPage
+		files   []File
+	)
+	for _, p := range job {
+		if s.db.Exists(p.f) {
+			s.prefetcher.complete(p.f, true, nil)
+			continue
+		}
+		missing = append(missing, p)
+		files = append(files, p.f)
+	}
+	if len(missing) == 0 {
+		return
+	}
+	tokens, err := s.api.TokensContext(ctx, files)
+	if err != nil {
+		log.Println("prefetch:", "failed to get tokens:", err)
+	}
+	for _, p := range missing {
+		err := ErrDownloadFailed
+		if token, ok := tokens[p.f.String()]; ok {
+			err = s.prefetchPage(ctx, p, token)
+		}
+		if err != nil {
+			log.Println("prefetch:", "failed to prefetch", p.f, err)
+		}
+		s.prefetcher.complete(p.f, false, err)
+	}
+}
+
+// prefetchPage downloads file of gallery page to cache
+func (s *DefaultServer) prefetchPage(ctx context.Context, p prefetchPage, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.DownloadTimeout)
+	defer cancel()
+	u := s.requestURL(p.f, token, p.gid, p.page, p.f.HexID()+"."+p.f.Type.String())
+	rc, err := s.api.RequestFileContext(ctx, p.f, u)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := s.addFile(p.f, NewLimitedReader(rc, s.prefetcher.limiter, s.downloadLimiter), u.Host); err != nil {
+		return err
+	}
+	s.register(p.f)
+	log.Println("prefetch:", "cached", p.f)
+	return nil
+}
+
+// downloadRate returns bandwidth of downloads to cache,
+// which is limited by MaxDownloadBytesPerSecond or by
+// maximum bandwidth of client if former is not set
+func (s *DefaultServer) downloadRate() int64 {
+	if s.cfg.MaxDownloadBytesPerSecond > 0 {
+		return s.cfg.MaxDownloadBytesPerSecond
+	}
+	return s.settings().MaximumBytesPerSecond
+}
+
+// prefetch records requested gallery page and schedules
+// prefetch of following pages if prefetching is enabled
+func (s *DefaultServer) prefetch(f File, gid, page int) {
+	if s.prefetcher == nil {
+		return
+	}
+	s.prefetcher.observe(f, gid, page)
+}
+
+// prefetchHit records request of cached file for prefetch statistics
+func (s *DefaultServer) prefetchHit(f File) {
+	if s.prefetcher == nil {
+		return
+	}
+	s.prefetcher.hit(f)
+}
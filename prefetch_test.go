@@ -0,0 +1,114 @@
+package hath
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPrefetch(t *testing.T) {
+	Convey("Prefetch", t, func() {
+		const gid = 7
+		var files []File
+		contents := make(map[string][]byte)
+		for i := 0; i < 4; i++ {
+			f, data := randomFile(1024)
+			files = append(files, f)
+			contents[f.String()] = data
+		}
+
+		Convey("Budget", func() {
+			p := newPrefetcher(PrefetchConfig{Pages: 3, Budget: 1}, 0)
+			p.observe(files[2], gid, 3)
+			p.observe(files[1], gid, 2)
+			So(p.Stats().Scheduled, ShouldEqual, 1)
+			p.observe(files[0], gid, 1)
+			So(p.Stats().Dropped, ShouldEqual, 1)
+			job := <-p.jobs
+			So(job, ShouldHaveLength, 1)
+			So(job[0].f.String(), ShouldEqual, files[2].String())
+			So(job[0].page, ShouldEqual, 3)
+
+			// prefetched files are not scheduled again
+			p.complete(files[2], false, nil)
+			p.observe(files[1], gid, 2)
+			So(p.Stats().Scheduled, ShouldEqual, 1)
+			p.hit(files[2])
+			p.hit(files[2])
+			So(p.Stats().Hits, ShouldEqual, 1)
+			So(p.Stats().HitRatio(), ShouldEqual, 1)
+		})
+		Convey("Server", func() {
+			var (
+				healthy   int32
+				requested = make(chan string, 16)
+			)
+			server, cleanup := newProxyServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// /r/<fileid>/<token>/<gid>-<page>/<filename>
+				elems := strings.Split(r.URL.Path, "/")
+				if atomic.LoadInt32(&healthy) == 0 || len(elems) != 6 {
+					http.NotFound(w, r)
+					return
+				}
+				requested <- elems[2]
+				w.Write(contents[elems[2]])
+			}), func(cfg *ServerConfig) {
+				cfg.Prefetch.Enabled = true
+				cfg.Prefetch.Pages = 2
+			})
+			defer cleanup()
+			get := func(f File, page int) int {
+				u := fmt.Sprintf("%s/p/fileid=%s;token=token;gid=%d;page=%d/%s.jpg", server.url, f, gid, page, f.HexID())
+				res, err := http.Get(u)
+				So(err, ShouldBeNil)
+				defer res.Body.Close()
+				ioutil.ReadAll(res.Body)
+				return res.StatusCode
+			}
+
+			// pages are remembered even if download failed
+			for i, f := range files {
+				So(get(f, i+1), ShouldEqual, http.StatusInternalServerError)
+				server.waitDownloads()
+			}
+			atomic.StoreInt32(&healthy, 1)
+			So(get(files[0], 1), ShouldEqual, http.StatusOK)
+			// prefetch can reach upstream before proxy request
+			fetched := map[string]bool{<-requested: true, <-requested: true, <-requested: true}
+			So(fetched, ShouldResemble, map[string]bool{
+				files[0].String(): true, files[1].String(): true, files[2].String(): true,
+			})
+			deadline := time.Now().Add(time.Second * 2)
+			for server.prefetcher.Stats().Prefetched != 2 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond * 5)
+			}
+			So(server.prefetcher.Stats().Prefetched, ShouldEqual, 2)
+			So(server.db.Exists(files[1]), ShouldBeTrue)
+			So(server.db.Exists(files[2]), ShouldBeTrue)
+			So(server.db.Exists(files[3]), ShouldBeFalse)
+			So(server.api.calls(actionTokens), ShouldEqual, 1)
+
+			// page 3 is already prefetched, so only page 4 is requested
+			So(get(files[1], 2), ShouldEqual, http.StatusOK)
+			So(<-requested, ShouldEqual, files[3].String())
+			So(server.prefetcher.Stats().Hits, ShouldEqual, 1)
+			So(get(files[2], 3), ShouldEqual, http.StatusOK)
+			So(server.prefetcher.Stats().Hits, ShouldEqual, 2)
+			So(server.prefetcher.Stats().HitRatio(), ShouldBeGreaterThan, 0.5)
+
+			// jobs are not started after Close began waiting for tasks
+			server.setStopping()
+			next, _ := randomFile(1024)
+			server.prefetcher.jobs <- []prefetchPage{{galleryPage{gid, 5}, next}}
+			time.Sleep(time.Millisecond * 20)
+			So(len(server.prefetcher.jobs), ShouldEqual, 0)
+			So(server.api.calls(actionTokens), ShouldEqual, 2)
+		})
+	})
+}
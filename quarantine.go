@@ -0,0 +1,255 @@
+package hath
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// quarantineEntryBytes is minimum length of serialized entry
+	// file(38) + time(8) + host length(2)
+	quarantineEntryBytes = fileBytes + timeBytes + 2
+	quarantineKeyBytes   = timeBytes + HashSize
+
+	quarantineDefaultMaxEntries = 1000
+	quarantineDefaultMaxAge     = time.Hour * 24 * 7
+)
+
+var (
+	// ErrQuarantineNotFound is returned when there is no entry with such id
+	ErrQuarantineNotFound = errors.New("Entry not found in quarantine")
+	// ErrQuarantineBadEntry is returned when entry can not be deserialized
+	ErrQuarantineBadEntry = errors.New("Bad quarantine entry")
+)
+
+// QuarantineEntry is info about corrupt or rejected file
+// that is kept for inspection
+type QuarantineEntry struct {
+	File   File      `json:"file"`
+	Reason string    `json:"reason"`
+	Host   string    `json:"host"`
+	Time   time.Time `json:"time"`
+}
+
+// Key is unique key of entry in database,
+// sorted by time of quarantine
+// time(8) + hash(20)
+func (e QuarantineEntry) Key() []byte {
+	key := make([]byte, quarantineKeyBytes)
+	binary.BigEndian.PutUint64(key[:timeBytes], uint64(e.Time.UnixNano()))
+	copy(key[timeBytes:], e.File.Hash[:])
+	return key
+}
+
+// ID is hex representation of Key
+func (e QuarantineEntry) ID() string {
+	return hex.EncodeToString(e.Key())
+}
+
+// Bytes serializes entry into byte slice
+// file(38) + time(8) + host length(2) + host + reason
+func (e QuarantineEntry) Bytes() []byte {
+	result := make([]byte, quarantineEntryBytes, quarantineEntryBytes+len(e.Host)+len(e.Reason))
+	cursor := 0
+
+	copy(result[cursor:fileBytes], e.File.Bytes())
+	cursor += fileBytes
+
+	binary.BigEndian.PutUint64(result[cursor:cursor+timeBytes], uint64(e.Time.UnixNano()))
+	cursor += timeBytes
+
+	binary.BigEndian.PutUint16(result[cursor:cursor+2], uint16(len(e.Host)))
+	result = append(result, e.Host...)
+	result = append(result, e.Reason...)
+	return result
+}
+
+// QuarantineEntryFromBytes deserializes entry from byte slice
+func QuarantineEntryFromBytes(data []byte) (e QuarantineEntry, err error) {
+	if len(data) < quarantineEntryBytes {
+		return e, ErrQuarantineBadEntry
+	}
+	cursor := 0
+	if err = FileFromBytesTo(data[cursor:fileBytes], &e.File); err != nil {
+		return e, err
+	}
+	cursor += fileBytes
+
+	e.Time = time.Unix(0, int64(binary.BigEndian.Uint64(data[cursor:cursor+timeBytes])))
+	cursor += timeBytes
+
+	hostLength := int(binary.BigEndian.Uint16(data[cursor : cursor+2]))
+	cursor += 2
+	if len(data) < cursor+hostLength {
+		return e, ErrQuarantineBadEntry
+	}
+	e.Host = string(data[cursor : cursor+hostLength])
+	cursor += hostLength
+	e.Reason = string(data[cursor:])
+	return e, nil
+}
+
+// ParseQuarantineID parses hex entry id into database key
+func ParseQuarantineID(id string) ([]byte, error) {
+	key, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != quarantineKeyBytes {
+		return nil, ErrQuarantineBadEntry
+	}
+	return key, nil
+}
+
+// Quarantine keeps corrupt or rejected files together
+// with the reason, source host and time of rejection,
+// so flaky upstream hosts can be found later
+type Quarantine struct {
+	dir        string
+	db         DataBase
+	maxEntries int
+	maxAge     time.Duration
+	mu         sync.Mutex
+}
+
+// NewQuarantine creates quarantine that stores payloads in dir
+// and entries in db, keeping no more than maxEntries that are
+// not older than maxAge
+func NewQuarantine(dir string, db DataBase, maxEntries int, maxAge time.Duration) (*Quarantine, error) {
+	if maxEntries <= 0 {
+		maxEntries = quarantineDefaultMaxEntries
+	}
+	if maxAge <= 0 {
+		maxAge = quarantineDefaultMaxAge
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &Quarantine{dir: dir, db: db, maxEntries: maxEntries, maxAge: maxAge}, nil
+}
+
+// path returns path to payload of entry
+func (q *Quarantine) path(e QuarantineEntry) string {
+	return path.Join(q.dir, e.ID())
+}
+
+// Add saves payload of file f read from r to quarantine
+// and applies retention limits
+func (q *Quarantine) Add(f File, r io.Reader, reason error, host string) (e QuarantineEntry, err error) {
+	e.File = f
+	e.Host = host
+	e.Time = time.Now()
+	if reason != nil {
+		e.Reason = reason.Error()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	payload, err := os.Create(q.path(e))
+	if err != nil {
+		return e, err
+	}
+	// payload can be truncated or too long, so copying it as is
+	_, err = io.Copy(payload, io.LimitReader(r, FileMaximumSize))
+	payload.Close()
+	if err != nil {
+		os.Remove(q.path(e))
+		return e, err
+	}
+	if err = q.db.AddQuarantined(e); err != nil {
+		os.Remove(q.path(e))
+		return e, err
+	}
+	log.Println("quarantine:", "added", f, "from", host, "reason:", e.Reason)
+	return e, q.collect(e.Time)
+}
+
+// List returns all entries in quarantine, oldest first
+func (q *Quarantine) List() ([]QuarantineEntry, error) {
+	return q.db.QuarantinedEntries()
+}
+
+// Get returns entry with provided id
+func (q *Quarantine) Get(id string) (e QuarantineEntry, err error) {
+	key, err := ParseQuarantineID(id)
+	if err != nil {
+		return e, err
+	}
+	return q.db.GetQuarantined(key)
+}
+
+// Open returns payload of entry with provided id
+func (q *Quarantine) Open(id string) (io.ReadCloser, error) {
+	e, err := q.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(q.path(e))
+}
+
+// Remove deletes entry and its payload from quarantine
+func (q *Quarantine) Remove(id string) error {
+	e, err := q.Get(id)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.remove(e)
+}
+
+func (q *Quarantine) remove(e QuarantineEntry) error {
+	if err := os.Remove(q.path(e)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return q.db.RemoveQuarantined(e.Key())
+}
+
+// Purge deletes all entries from quarantine
+func (q *Quarantine) Purge() (count int, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries, err := q.List()
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if err := q.remove(e); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Collect removes entries that are out of retention limits
+func (q *Quarantine) Collect() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.collect(time.Now())
+}
+
+func (q *Quarantine) collect(now time.Time) error {
+	entries, err := q.List()
+	if err != nil {
+		return err
+	}
+	// entries are sorted by key, so oldest are first
+	deadline := now.Add(-q.maxAge)
+	for i, e := range entries {
+		if e.Time.After(deadline) && len(entries)-i <= q.maxEntries {
+			break
+		}
+		if err := q.remove(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package hath
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestQuarantineEntry(t *testing.T) {
+	Convey("Quarantine entry", t, func() {
+		g := FileGenerator{
+			SizeMax:       randFileSizeMax,
+			SizeMin:       randFileSizeMin,
+			ResolutionMax: randFileResolutionMax,
+			ResolutionMin: randFileResolutionMin,
+		}
+		e := QuarantineEntry{
+			File:   g.NewFake(),
+			Reason: ErrFileInconsistent.Error(),
+			Host:   "127.0.0.1:8080",
+			Time:   time.Now(),
+		}
+		Convey("Serialization", func() {
+			parsed, err := QuarantineEntryFromBytes(e.Bytes())
+			So(err, ShouldBeNil)
+			So(parsed.File.String(), ShouldEqual, e.File.String())
+			So(parsed.Reason, ShouldEqual, e.Reason)
+			So(parsed.Host, ShouldEqual, e.Host)
+			So(parsed.Time.Equal(e.Time), ShouldBeTrue)
+			So(parsed.ID(), ShouldEqual, e.ID())
+		})
+		Convey("Bad data", func() {
+			_, err := QuarantineEntryFromBytes(e.Bytes()[:quarantineEntryBytes-1])
+			So(err, ShouldEqual, ErrQuarantineBadEntry)
+		})
+		Convey("ID", func() {
+			key, err := ParseQuarantineID(e.ID())
+			So(err, ShouldBeNil)
+			So(bytes.Equal(key, e.Key()), ShouldBeTrue)
+			_, err = ParseQuarantineID("abcd")
+			So(err, ShouldEqual, ErrQuarantineBadEntry)
+		})
+	})
+}
+
+func TestQuarantine(t *testing.T) {
+	Convey("Quarantine", t, func() {
+		g := FileGenerator{
+			SizeMax:       randFileSizeMax,
+			SizeMin:       randFileSizeMin,
+			ResolutionMax: randFileResolutionMax,
+			ResolutionMin: randFileResolutionMin,
+		}
+		testDir, err := ioutil.TempDir("", randDirPrefix)
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(testDir)
+		db, err := NewDB(path.Join(testDir, "bolt.db"))
+		So(err, ShouldBeNil)
+		defer db.Close()
+		maxEntries := 3
+		q, err := NewQuarantine(path.Join(testDir, "quarantine"), db, maxEntries, time.Hour)
+		So(err, ShouldBeNil)
+
+		f := g.NewFake()
+		payload := []byte("bad payload")
+		e, err := q.Add(f, bytes.NewReader(payload), ErrFileInconsistent, "bad.host")
+		So(err, ShouldBeNil)
+
+		Convey("List", func() {
+			entries, err := q.List()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+			So(entries[0].ID(), ShouldEqual, e.ID())
+			So(entries[0].Reason, ShouldEqual, ErrFileInconsistent.Error())
+			So(entries[0].Host, ShouldEqual, "bad.host")
+		})
+		Convey("Get", func() {
+			got, err := q.Get(e.ID())
+			So(err, ShouldBeNil)
+			So(got.File.String(), ShouldEqual, f.String())
+		})
+		Convey("Payload", func() {
+			rc, err := q.Open(e.ID())
+			So(err, ShouldBeNil)
+			defer rc.Close()
+			data, err := ioutil.ReadAll(rc)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(data, payload), ShouldBeTrue)
+		})
+		Convey("Remove", func() {
+			So(q.Remove(e.ID()), ShouldBeNil)
+			_, err := q.Get(e.ID())
+			So(err, ShouldEqual, ErrQuarantineNotFound)
+			_, err = os.Stat(q.path(e))
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+		Convey("Retention", func() {
+			for i := 0; i < maxEntries*2; i++ {
+				_, err := q.Add(g.NewFake(), bytes.NewReader(payload), errors.New("test"), "other.host")
+				So(err, ShouldBeNil)
+			}
+			entries, err := q.List()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, maxEntries)
+			// oldest entries are removed first
+			for _, e := range entries {
+				So(e.Host, ShouldEqual, "other.host")
+			}
+		})
+		Convey("Purge", func() {
+			count, err := q.Purge()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 1)
+			entries, err := q.List()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,298 @@
+package hath
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// queueEntryBytes is minimum length of serialized entry
+	// file(38) + added(8) + next retry(8) + attempts(4) + url length(2)
+	queueEntryBytes = fileBytes + timeBytes*2 + 4 + 2
+
+	// queueMaxRetryBackoff is maximum delay between retries of queued download
+	queueMaxRetryBackoff = time.Hour * 6
+)
+
+var (
+	// ErrQueueBadEntry is returned when entry can not be deserialized
+	ErrQueueBadEntry = errors.New("Bad download queue entry")
+	// ErrQueueNotFound is returned when file is not queued
+	ErrQueueNotFound = errors.New("Queued download not found")
+)
+
+// QueueEntry is pending download of file that failed earlier
+type QueueEntry struct {
+	File File `json:"file"`
+	// URL is source of file from cache_files, on-demand
+	// downloads have no url and request new token on retry
+	URL       string    `json:"url,omitempty"`
+	Attempts  int       `json:"attempts"`
+	NextRetry time.Time `json:"next_retry"`
+	Added     time.Time `json:"added"`
+	Error     string    `json:"error"`
+}
+
+// Key is unique key of entry in database, hash of file
+func (e QueueEntry) Key() []byte {
+	return e.File.Hash[:]
+}
+
+// Bytes serializes entry into byte slice
+// file(38) + added(8) + next retry(8) + attempts(4) + url length(2) + url + error
+func (e QueueEntry) Bytes() []byte {
+	result := make([]byte, queueEntryBytes, queueEntryBytes+len(e.URL)+len(e.Error))
+	cursor := 0
+
+	copy(result[cursor:fileBytes], e.File.Bytes())
+	cursor += fileBytes
+
+	binary.BigEndian.PutUint64(result[cursor:cursor+timeBytes], uint64(e.Added.UnixNano()))
+	cursor += timeBytes
+
+	binary.BigEndian.PutUint64(result[cursor:cursor+timeBytes], uint64(e.NextRetry.UnixNano()))
+	cursor += timeBytes
+
+	binary.BigEndian.PutUint32(result[cursor:cursor+4], uint32(e.Attempts))
+	cursor += 4
+
+	binary.BigEndian.PutUint16(result[cursor:cursor+2], uint16(len(e.URL)))
+	result = append(result, e.URL...)
+	result = append(result, e.Error...)
+	return result
+}
+
+// QueueEntryFromBytes deserializes entry from byte slice
+func QueueEntryFromBytes(data []byte) (e QueueEntry, err error) {
+	if len(data) < queueEntryBytes {
+		return e, ErrQueueBadEntry
+	}
+	cursor := 0
+	if err = FileFromBytesTo(data[cursor:fileBytes], &e.File); err != nil {
+		return e, err
+	}
+	cursor += fileBytes
+
+	e.Added = time.Unix(0, int64(binary.BigEndian.Uint64(data[cursor:cursor+timeBytes])))
+	cursor += timeBytes
+
+	e.NextRetry = time.Unix(0, int64(binary.BigEndian.Uint64(data[cursor:cursor+timeBytes])))
+	cursor += timeBytes
+
+	e.Attempts = int(binary.BigEndian.Uint32(data[cursor : cursor+4]))
+	cursor += 4
+
+	urlLength := int(binary.BigEndian.Uint16(data[cursor : cursor+2]))
+	cursor += 2
+	if len(data) < cursor+urlLength {
+		return e, ErrQueueBadEntry
+	}
+	e.URL = string(data[cursor : cursor+urlLength])
+	cursor += urlLength
+	e.Error = string(data[cursor:])
+	return e, nil
+}
+
+// enqueue saves failed download of file for retry, u is nil for
+// on-demand downloads; attempts of already queued file are kept
+func (s *DefaultServer) enqueue(f File, u *url.URL, reason error) {
+	now := time.Now()
+	e, err := s.db.GetQueued(f)
+	added := err == ErrQueueNotFound
+	if added {
+		e = QueueEntry{File: f, Added: now, NextRetry: now}
+	} else if err != nil {
+		log.Println("server:", "failed to load queued download of", f, err)
+		return
+	}
+	if u != nil {
+		e.URL = u.String()
+	}
+	if reason != nil {
+		e.Error = reason.Error()
+	}
+	if err := s.db.AddQueued(e); err != nil {
+		log.Println("server:", "failed to queue download of", f, err)
+		return
+	}
+	log.Println("server:", "queued download of", f)
+	if added {
+		atomic.AddInt64(&s.queued, 1)
+	}
+}
+
+// updateQueueStats counts queued downloads
+func (s *DefaultServer) updateQueueStats() {
+	entries, err := s.db.QueuedEntries()
+	if err != nil {
+		log.Println("server:", "failed to count queued downloads:", err)
+		return
+	}
+	atomic.StoreInt64(&s.queued, int64(len(entries)))
+}
+
+// openQueued opens source of file of queue entry
+func (s *DefaultServer) openQueued(ctx context.Context, e QueueEntry) (io.ReadCloser, *url.URL, error) {
+	if len(e.URL) != 0 {
+		u, err := url.Parse(e.URL)
+		if err != nil {
+			return nil, nil, err
+		}
+		rc, err := s.api.GetFileContext(ctx, u)
+		return rc, u, err
+	}
+
+	// token of on-demand download is requested again, because it can expire
+	tokens, err := s.api.TokensContext(ctx, []File{e.File})
+	if err != nil {
+		return nil, nil, err
+	}
+	token, ok := tokens[e.File.String()]
+	if !ok {
+		return nil, nil, ErrDownloadFailed
+	}
+	u := s.requestURL(e.File, token, 1, 1, onDemandFilename)
+	rc, err := s.api.RequestFileContext(ctx, e.File, u)
+	return rc, u, err
+}
+
+// fetchQueued downloads file of queue entry to cache; download
+// is shared with concurrent requests of same file, stored is false
+// if file was cached by other request
+func (s *DefaultServer) fetchQueued(ctx context.Context, e QueueEntry) (stored bool, err error) {
+	if s.db.Exists(e.File) {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.DownloadTimeout)
+	defer cancel()
+	d, started := s.downloads.acquire(e.File)
+	defer d.leave()
+	if !started {
+		// file is already downloaded by user request
+		_, err := io.Copy(ioutil.Discard, d.NewReader(ctx))
+		return false, err
+	}
+
+	rc, u, err := s.openQueued(ctx, e)
+	if err == nil {
+		err = receive(d, e.File, NewLimitedReader(rc, s.downloadLimiter))
+		rc.Close()
+	}
+	if err != nil {
+		if err == ErrFileInconsistent && s.quarantine != nil {
+			if _, qErr := s.quarantine.Add(e.File, bytes.NewReader(d.Bytes()), err, u.Host); qErr != nil {
+				log.Println("server: failed to quarantine:", e.File, qErr)
+			}
+		}
+		s.downloads.remove(e.File, d)
+		d.finish(err)
+		return false, err
+	}
+	d.finish(nil)
+	defer s.downloads.remove(e.File, d)
+	if err := s.addFile(e.File, bytes.NewReader(d.Bytes()), u.Host); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// processQueue retries queued downloads that are due at now
+// and returns count of completed ones
+func (s *DefaultServer) processQueue(ctx context.Context, now time.Time) (completed int, err error) {
+	entries, err := s.db.QueuedEntries()
+	if err != nil {
+		return 0, err
+	}
+	atomic.StoreInt64(&s.queued, int64(len(entries)))
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+		if e.NextRetry.After(now) {
+			continue
+		}
+		stored, fetchErr := s.fetchQueued(ctx, e)
+		if fetchErr == nil {
+			log.Println("server:", "queued download of", e.File, "completed")
+			completed++
+			if err := s.db.RemoveQueued(e.File); err != nil {
+				return completed, err
+			}
+			atomic.AddInt64(&s.queued, -1)
+			if stored && len(e.URL) != 0 {
+				// failed cache_files download was reported to rpc
+				// server, so file is registered after retry
+				s.register(e.File)
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			// server is stopping, entry is kept as is
+			break
+		}
+		e.Attempts++
+		e.Error = fetchErr.Error()
+		if e.Attempts >= s.cfg.QueueMaxAttempts {
+			log.Println("server:", "dropping queued download of", e.File, "after", e.Attempts, "attempts:", fetchErr)
+			if err := s.db.RemoveQueued(e.File); err != nil {
+				return completed, err
+			}
+			atomic.AddInt64(&s.queued, -1)
+			continue
+		}
+		e.NextRetry = now.Add(backoff(e.Attempts-1, s.cfg.QueueRetryBackoff, queueMaxRetryBackoff))
+		log.Println("server:", "queued download of", e.File, "failed, next retry at", e.NextRetry, fetchErr)
+		if err := s.db.AddQueued(e); err != nil {
+			return completed, err
+		}
+	}
+	return completed, nil
+}
+
+func (s *DefaultServer) queueLoop() {
+	defer s.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	ticker := time.NewTicker(s.cfg.QueueInterval)
+	defer ticker.Stop()
+	s.updateQueueStats()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.processQueue(ctx, time.Now()); err != nil {
+				log.Println("server:", "failed to process download queue:", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// handleQueue returns pending downloads
+// GET /api/queue
+func (s *DefaultServer) handleQueue(c *gin.Context) {
+	entries, err := s.db.QueuedEntries()
+	if err != nil {
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
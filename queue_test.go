@@ -0,0 +1,180 @@
+package hath
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestQueue(t *testing.T) {
+	Convey("Download queue", t, func() {
+		f, data := randomFile(1024)
+		Convey("Entry", func() {
+			e := QueueEntry{
+				File:      f,
+				URL:       "http://127.0.0.1:8080/image.php?f=id&t=key",
+				Attempts:  3,
+				Added:     time.Unix(0, 12345),
+				NextRetry: time.Unix(0, 54321),
+				Error:     "failed",
+			}
+			decoded, err := QueueEntryFromBytes(e.Bytes())
+			So(err, ShouldBeNil)
+			So(decoded.File.String(), ShouldEqual, f.String())
+			So(decoded.URL, ShouldEqual, e.URL)
+			So(decoded.Attempts, ShouldEqual, 3)
+			So(decoded.Added.Equal(e.Added), ShouldBeTrue)
+			So(decoded.NextRetry.Equal(e.NextRetry), ShouldBeTrue)
+			So(decoded.Error, ShouldEqual, "failed")
+			_, err = QueueEntryFromBytes([]byte("bad"))
+			So(err, ShouldEqual, ErrQueueBadEntry)
+		})
+
+		var (
+			requests int32
+			healthy  int32
+		)
+		server, cleanup := newProxyServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			if atomic.LoadInt32(&healthy) == 0 {
+				http.Error(w, "maintenance", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write(data)
+		}), func(cfg *ServerConfig) {
+			cfg.DownloadRetries = -1
+			cfg.QueueRetryBackoff = time.Minute
+			cfg.QueueMaxAttempts = 3
+			cfg.Settings.RPCServers = []net.IP{net.ParseIP("127.0.0.1")}
+		})
+		defer cleanup()
+		statuses := server.command("cache_files", fmt.Sprintf("%s:%s=key", f, server.upstream))
+		So(statuses, ShouldResemble, []string{f.String() + ":" + downloadError})
+		entries, err := server.db.QueuedEntries()
+		So(err, ShouldBeNil)
+		So(len(entries), ShouldEqual, 1)
+		So(entries[0].URL, ShouldContainSubstring, server.upstream)
+		So(atomic.LoadInt64(&server.queued), ShouldEqual, 1)
+
+		ctx := context.Background()
+		now := time.Now()
+		Convey("Retry", func() {
+			completed, err := server.processQueue(ctx, now)
+			So(err, ShouldBeNil)
+			So(completed, ShouldEqual, 0)
+			entries, err := server.db.QueuedEntries()
+			So(err, ShouldBeNil)
+			So(entries[0].Attempts, ShouldEqual, 1)
+			So(entries[0].NextRetry, ShouldHappenAfter, now.Add(time.Second*29))
+			So(entries[0].Error, ShouldNotBeEmpty)
+
+			// entry is not due yet
+			atomic.StoreInt32(&healthy, 1)
+			requested := atomic.LoadInt32(&requests)
+			completed, err = server.processQueue(ctx, now)
+			So(err, ShouldBeNil)
+			So(completed, ShouldEqual, 0)
+			So(atomic.LoadInt32(&requests), ShouldEqual, requested)
+
+			completed, err = server.processQueue(ctx, now.Add(time.Minute))
+			So(err, ShouldBeNil)
+			So(completed, ShouldEqual, 1)
+			So(server.db.Exists(f), ShouldBeTrue)
+			So(atomic.LoadInt64(&server.queued), ShouldEqual, 0)
+
+			// late success is reported to rpc server
+			deadline := time.Now().Add(time.Second * 2)
+			for server.api.calls(actionFileAdd) == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond * 5)
+			}
+			So(server.api.calls(actionFileAdd), ShouldEqual, 1)
+		})
+		Convey("Shared", func() {
+			d, started := server.downloads.acquire(f)
+			So(started, ShouldBeTrue)
+			requested := atomic.LoadInt32(&requests)
+			var stored bool
+			done := make(chan error, 1)
+			go func() {
+				var err error
+				stored, err = server.fetchQueued(ctx, entries[0])
+				done <- err
+			}()
+			d.Write(data)
+			d.finish(nil)
+			So(<-done, ShouldBeNil)
+			// file is stored and registered by user request
+			So(stored, ShouldBeFalse)
+			So(atomic.LoadInt32(&requests), ShouldEqual, requested)
+			server.downloads.remove(f, d)
+			d.leave()
+		})
+		Convey("Failed again", func() {
+			_, err := server.processQueue(ctx, now)
+			So(err, ShouldBeNil)
+			server.enqueue(f, nil, errors.New("failed again"))
+			merged, err := server.db.QueuedEntries()
+			So(err, ShouldBeNil)
+			So(len(merged), ShouldEqual, 1)
+			So(merged[0].Attempts, ShouldEqual, 1)
+			So(merged[0].Added.Equal(entries[0].Added), ShouldBeTrue)
+			So(merged[0].URL, ShouldEqual, entries[0].URL)
+			So(merged[0].Error, ShouldEqual, "failed again")
+			So(atomic.LoadInt64(&server.queued), ShouldEqual, 1)
+		})
+		Convey("Drop", func() {
+			for i := 0; i < 3; i++ {
+				_, err := server.processQueue(ctx, now.Add(time.Hour*time.Duration(i)))
+				So(err, ShouldBeNil)
+			}
+			entries, err := server.db.QueuedEntries()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 0)
+		})
+		Convey("Restart", func() {
+			So(server.Close(), ShouldBeNil)
+			db, err := NewDB(path.Join(server.dir, "bolt.db"))
+			So(err, ShouldBeNil)
+			defer db.Close()
+			entries, err := db.QueuedEntries()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 1)
+			So(entries[0].File.String(), ShouldEqual, f.String())
+		})
+	})
+}
+
+func TestQueueOnDemand(t *testing.T) {
+	Convey("Failed on-demand download is queued", t, func() {
+		f, _ := randomFile(1024)
+		server, cleanup := newProxyServer(http.NotFoundHandler(), func(cfg *ServerConfig) {
+			cfg.Settings.StaticRanges = StaticRanges{f.Range(): true}
+		})
+		defer cleanup()
+		res, err := http.Get(server.fileURL(f))
+		So(err, ShouldBeNil)
+		res.Body.Close()
+		So(res.StatusCode, ShouldEqual, http.StatusInternalServerError)
+		server.waitDownloads()
+		entries, err := server.db.QueuedEntries()
+		So(err, ShouldBeNil)
+		So(len(entries), ShouldEqual, 1)
+		So(entries[0].URL, ShouldBeEmpty)
+
+		// token is requested again on retry
+		_, err = server.processQueue(context.Background(), time.Now())
+		So(err, ShouldBeNil)
+		So(server.api.calls(actionTokens), ShouldEqual, 1)
+		entries, err = server.db.QueuedEntries()
+		So(err, ShouldBeNil)
+		So(entries[0].Attempts, ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,209 @@
+package hath
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ipv4SubnetBits = 24
+	ipv6SubnetBits = 64
+
+	rateLimitCleanupInterval = time.Minute
+)
+
+// RateLimitConfig is configuration for per-ip and per-subnet
+// connection and request rate limits of file requests,
+// zero values disable limit
+type RateLimitConfig struct {
+	// MaxConnectionsPerIP is maximum count of concurrent requests from one ip
+	MaxConnectionsPerIP int
+	// MaxConnectionsPerSubnet is maximum count of concurrent requests
+	// from one /24 for ipv4 or /64 for ipv6 subnet
+	MaxConnectionsPerSubnet int
+	// RequestsPerIP is allowed average rate of requests per second from one ip
+	RequestsPerIP float64
+	// RequestsPerSubnet is allowed average rate of requests per second from one subnet
+	RequestsPerSubnet float64
+	// RequestBurst is maximum count of requests above average rate,
+	// equals to rate if zero
+	RequestBurst float64
+	// ExemptRPCServers disables limits for Settings.RPCServers
+	ExemptRPCServers bool
+	// ExemptLocalNetworks disables limits for LocalNetworks
+	ExemptLocalNetworks bool
+}
+
+// Enabled returns true if any limit is set
+func (cfg RateLimitConfig) Enabled() bool {
+	return cfg.MaxConnectionsPerIP > 0 || cfg.MaxConnectionsPerSubnet > 0 ||
+		cfg.RequestsPerIP > 0 || cfg.RequestsPerSubnet > 0
+}
+
+// Subnet returns /24 network for ipv4 and /64 network for ipv6 address
+func Subnet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(ipv4SubnetBits, 8*net.IPv4len)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(ipv6SubnetBits, 8*net.IPv6len)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// rateLimitState is state of limits for single ip or subnet
+type rateLimitState struct {
+	connections int
+	tokens      float64
+	last        time.Time
+}
+
+// rateLimiter counts concurrent connections and
+// request rates for ip addresses and subnets
+type rateLimiter struct {
+	cfg         RateLimitConfig
+	mu          sync.Mutex
+	ips         map[string]*rateLimitState
+	subnets     map[string]*rateLimitState
+	lastCleanup time.Time
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		cfg:         cfg,
+		ips:         make(map[string]*rateLimitState),
+		subnets:     make(map[string]*rateLimitState),
+		lastCleanup: time.Now(),
+	}
+}
+
+func getRateLimitState(states map[string]*rateLimitState, key string, burst float64, now time.Time) *rateLimitState {
+	state, ok := states[key]
+	if !ok {
+		state = &rateLimitState{tokens: burst, last: now}
+		states[key] = state
+	}
+	return state
+}
+
+// refill adds tokens for elapsed time and returns true if request is allowed
+func (state *rateLimitState) refill(rate, burst float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	state.tokens += now.Sub(state.last).Seconds() * rate
+	if state.tokens > burst {
+		state.tokens = burst
+	}
+	state.last = now
+	return state.tokens >= 1
+}
+
+func (l *rateLimiter) burst(rate float64) float64 {
+	if l.cfg.RequestBurst > 0 {
+		return l.cfg.RequestBurst
+	}
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// acquire returns true and registers connection from ip
+// if it is in limits; release should be called after request
+func (l *rateLimiter) acquire(ip net.IP) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cleanup(now)
+
+	ipBurst := l.burst(l.cfg.RequestsPerIP)
+	subnetBurst := l.burst(l.cfg.RequestsPerSubnet)
+	ipState := getRateLimitState(l.ips, ip.String(), ipBurst, now)
+	subnetState := getRateLimitState(l.subnets, Subnet(ip).String(), subnetBurst, now)
+
+	if l.cfg.MaxConnectionsPerIP > 0 && ipState.connections >= l.cfg.MaxConnectionsPerIP {
+		return false
+	}
+	if l.cfg.MaxConnectionsPerSubnet > 0 && subnetState.connections >= l.cfg.MaxConnectionsPerSubnet {
+		return false
+	}
+	if !ipState.refill(l.cfg.RequestsPerIP, ipBurst, now) {
+		return false
+	}
+	if !subnetState.refill(l.cfg.RequestsPerSubnet, subnetBurst, now) {
+		return false
+	}
+	if l.cfg.RequestsPerIP > 0 {
+		ipState.tokens--
+	}
+	if l.cfg.RequestsPerSubnet > 0 {
+		subnetState.tokens--
+	}
+	ipState.connections++
+	subnetState.connections++
+	return true
+}
+
+// release unregisters connection from ip
+func (l *rateLimiter) release(ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if state, ok := l.ips[ip.String()]; ok && state.connections > 0 {
+		state.connections--
+	}
+	if state, ok := l.subnets[Subnet(ip).String()]; ok && state.connections > 0 {
+		state.connections--
+	}
+}
+
+// cleanup removes idle states that are same as new ones
+func (l *rateLimiter) cleanup(now time.Time) {
+	if now.Sub(l.lastCleanup) < rateLimitCleanupInterval {
+		return
+	}
+	l.lastCleanup = now
+	clean := func(states map[string]*rateLimitState, rate float64) {
+		for key, state := range states {
+			if state.connections > 0 {
+				continue
+			}
+			if rate > 0 && state.tokens+now.Sub(state.last).Seconds()*rate < l.burst(rate) {
+				continue
+			}
+			delete(states, key)
+		}
+	}
+	clean(l.ips, l.cfg.RequestsPerIP)
+	clean(l.subnets, l.cfg.RequestsPerSubnet)
+}
+
+// rateLimit aborts request with 429 if limits for
+// remote ip or its subnet are exceeded
+func (s *DefaultServer) rateLimit(c *gin.Context) {
+	ip, err := FromRequest(c.Request)
+	if err != nil {
+		c.Next()
+		return
+	}
+	if s.cfg.RateLimit.ExemptRPCServers && s.settings().IsRPCServer(c.Request) {
+		c.Next()
+		return
+	}
+	if s.cfg.RateLimit.ExemptLocalNetworks && IsLocal(ip) {
+		c.Next()
+		return
+	}
+	if !s.rateLimiter.acquire(ip) {
+		log.Println("server:", "rate limit exceeded by", ip)
+		c.String(http.StatusTooManyRequests, "429: too many requests")
+		c.Abort()
+		return
+	}
+	defer s.rateLimiter.release(ip)
+	c.Next()
+}
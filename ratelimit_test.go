@@ -0,0 +1,107 @@
+package hath
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSubnet(t *testing.T) {
+	Convey("Subnet", t, func() {
+		So(Subnet(net.ParseIP("192.0.2.15")).String(), ShouldEqual, "192.0.2.0/24")
+		So(Subnet(net.ParseIP("2001:db8:1:2:3:4:5:6")).String(), ShouldEqual, "2001:db8:1:2::/64")
+	})
+}
+
+func TestRateLimiter(t *testing.T) {
+	Convey("Rate limiter", t, func() {
+		ip := net.ParseIP("192.0.2.15")
+		neighbour := net.ParseIP("192.0.2.16")
+		other := net.ParseIP("198.51.100.1")
+		Convey("Connections per ip", func() {
+			l := newRateLimiter(RateLimitConfig{MaxConnectionsPerIP: 2})
+			So(l.acquire(ip), ShouldBeTrue)
+			So(l.acquire(ip), ShouldBeTrue)
+			So(l.acquire(ip), ShouldBeFalse)
+			So(l.acquire(neighbour), ShouldBeTrue)
+			l.release(ip)
+			So(l.acquire(ip), ShouldBeTrue)
+		})
+		Convey("Connections per subnet", func() {
+			l := newRateLimiter(RateLimitConfig{MaxConnectionsPerSubnet: 2})
+			So(l.acquire(ip), ShouldBeTrue)
+			So(l.acquire(neighbour), ShouldBeTrue)
+			So(l.acquire(ip), ShouldBeFalse)
+			So(l.acquire(other), ShouldBeTrue)
+			l.release(neighbour)
+			So(l.acquire(ip), ShouldBeTrue)
+		})
+		Convey("Requests per ip", func() {
+			l := newRateLimiter(RateLimitConfig{RequestsPerIP: 0.001, RequestBurst: 3})
+			for i := 0; i < 3; i++ {
+				So(l.acquire(ip), ShouldBeTrue)
+				l.release(ip)
+			}
+			So(l.acquire(ip), ShouldBeFalse)
+			So(l.acquire(neighbour), ShouldBeTrue)
+		})
+		Convey("Middleware", func() {
+			gin.SetMode(gin.TestMode)
+			s := new(DefaultServer)
+			s.cfg.RateLimit = RateLimitConfig{RequestsPerIP: 0.001, RequestBurst: 1}
+			s.rateLimiter = newRateLimiter(s.cfg.RateLimit)
+			e := gin.New()
+			e.Use(s.rateLimit)
+			e.GET("/", func(c *gin.Context) {
+				c.String(http.StatusOK, "OK")
+			})
+			do := func(remoteAddr string) int {
+				req, err := http.NewRequest(httpGET, "/", nil)
+				So(err, ShouldBeNil)
+				req.RemoteAddr = remoteAddr
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+				return rec.Code
+			}
+			So(do("192.0.2.15:1234"), ShouldEqual, http.StatusOK)
+			So(do("192.0.2.15:1235"), ShouldEqual, http.StatusTooManyRequests)
+			Convey("Exempt local networks", func() {
+				s.cfg.RateLimit.ExemptLocalNetworks = true
+				So(do("127.0.0.1:1234"), ShouldEqual, http.StatusOK)
+				So(do("127.0.0.1:1235"), ShouldEqual, http.StatusOK)
+			})
+			Convey("Exempt rpc servers", func() {
+				s.cfg.RateLimit.ExemptRPCServers = true
+				s.cfg.Settings.RPCServers = []net.IP{net.ParseIP("198.51.100.1")}
+				So(do("198.51.100.1:1234"), ShouldEqual, http.StatusOK)
+				So(do("198.51.100.1:1235"), ShouldEqual, http.StatusOK)
+			})
+		})
+		Convey("Routes", func() {
+			f, data := randomFile(1024)
+			server, cleanup := newProxyServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(data)
+			}), func(cfg *ServerConfig) {
+				cfg.RateLimit = RateLimitConfig{RequestsPerIP: 0.001, RequestBurst: 1}
+			})
+			defer cleanup()
+			get := func(u string) int {
+				res, err := http.Get(u)
+				So(err, ShouldBeNil)
+				ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				return res.StatusCode
+			}
+			So(get(server.fileURL(f)), ShouldEqual, http.StatusOK)
+			So(get(server.fileURL(f)), ShouldEqual, http.StatusTooManyRequests)
+			server.waitDownloads()
+			So(get(server.url+"/api/stats"), ShouldEqual, http.StatusOK)
+			So(get(server.url+"/metrics"), ShouldEqual, http.StatusOK)
+		})
+	})
+}
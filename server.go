@@ -2,6 +2,8 @@
 package hath
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
@@ -15,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -45,18 +48,35 @@ func (s speedTest) Write(b []byte) (n int, err error) {
 // Stats for server
 type Stats struct {
 	FilesTotal           int
+	FilesTotalBytes      int64
 	FilesSent            int
 	FilesSentBytes       int64
 	FilesDownloaded      int
 	FilesDownloadedBytes int64
 	Started              time.Time
 	Uptime               time.Duration
+	Load                 Load
+	DownloadsQueued      int
+	Prefetch             PrefetchStats
 }
 
 // Event from server
 type Event struct {
 	Type EventType
+	Time time.Time
 	File File
+	// IP is remote address of request that caused event
+	IP net.IP
+	// Route is route of request, e.g. "h" or "p"
+	Route string
+	// Bytes is count of sent or received bytes
+	Bytes int64
+	// Duration is duration of request, download or rpc call
+	Duration time.Duration
+	// Action is rpc action of EventRPC
+	Action string
+	// Error is description of failure
+	Error string
 }
 
 // EventType is type of event from server
@@ -71,6 +91,12 @@ const (
 	EventAdded
 	// EventRemoved issued when file is removed from cache
 	EventRemoved
+	// EventEvicted issued when unused file is removed from cache
+	EventEvicted
+	// EventError issued when request or download failed
+	EventError
+	// EventRPC issued when rpc call is completed
+	EventRPC
 )
 
 func (t EventType) String() string {
@@ -86,6 +112,15 @@ func (t EventType) String() string {
 	if t == EventRemoved {
 		return "removed"
 	}
+	if t == EventEvicted {
+		return "evicted"
+	}
+	if t == EventError {
+		return "error"
+	}
+	if t == EventRPC {
+		return "rpc"
+	}
 	return "unknown"
 }
 
@@ -101,14 +136,17 @@ func (s *Stats) Process(e Event) {
 	}
 	if e.Type == EventAdded {
 		s.FilesTotal++
+		s.FilesTotalBytes += e.File.Size
 	}
-	if e.Type == EventRemoved {
+	if e.Type == EventRemoved || e.Type == EventEvicted {
 		s.FilesTotal--
+		s.FilesTotalBytes -= e.File.Size
 	}
 }
 
 // DefaultServer uses hard drive to respond
 type DefaultServer struct {
+	queued        int64 // atomic, count of queued downloads
 	api           *Client
 	cfg           ServerConfig
 	frontend      Frontend
@@ -121,9 +159,28 @@ type DefaultServer struct {
 	commands      map[string]commandHandler
 	stop          chan bool
 	updateLock    sync.Locker
-	stats         Stats
-	events        chan Event
+	stats         *statsCollector
+	events        *eventBus
 	headlessStart bool
+	quarantine    *Quarantine
+	limiter       *Limiter
+	rateLimiter   *rateLimiter
+	load          *loadMonitor
+	state         ServerState
+	stateLock     sync.Locker
+	resumeTimer   *time.Timer
+	httpServer    *http.Server
+	tasks         *sync.WaitGroup
+	certificates  *certificateManager
+	downloads     *downloads
+
+	downloadJobs    chan downloadJob
+	downloadLimiter *Limiter
+	prefetcher      *prefetcher
+	metrics         *Metrics
+
+	// settingsLock guards cfg.Settings that are refreshed by rpc server
+	settingsLock sync.RWMutex
 }
 
 const (
@@ -140,13 +197,19 @@ const (
 	fileInfoDelimiter   = ":"
 	stillAliveInterval  = time.Minute * 5
 
+	// quarantineCollectInterval is interval of enforcing
+	// quarantine retention limits
+	quarantineCollectInterval = time.Minute
+	// registerPendingMax is maximum count of files kept for
+	// registration while rpc server is unavailable
+	registerPendingMax = 10000
+
 	downloadError     = "FAIL"
 	downloadSuccess   = "OK"
 	downloadInvalid   = "INVALID"
 	downloadPath      = "image.php"
 	argDownloadFileID = "f"
 	argDownloadKey    = "t"
-	downloadScheme    = "http"
 
 	cmdSpeedTest         = "speed_test"
 	cmdDownload          = "cache_files"
@@ -282,7 +345,8 @@ func FromRequest(req *http.Request) (net.IP, error) {
 }
 
 // addFile adds to cache and db, checks sha1
-func (s *DefaultServer) addFile(f File, r io.Reader) error {
+// host is source of file and is used only for quarantine
+func (s *DefaultServer) addFile(f File, r io.Reader, host string) error {
 	log.Println("server: adding file", f)
 	if s.db.Exists(f) {
 		log.Println("server:", f, "already exists")
@@ -290,22 +354,59 @@ func (s *DefaultServer) addFile(f File, r io.Reader) error {
 	}
 	if err := s.frontend.Add(f, r); err != nil {
 		log.Println("server: frontend fail:", f, err)
+		if err == ErrFileBadLength {
+			s.reject(f, err, host)
+		}
 		return err
 	}
 	if err := s.frontend.Check(f); err != nil {
 		log.Println("server: frontend integrity check failed:", f, err)
-		if err2 := s.frontend.Remove(f); err2 != nil {
-			log.Println("server: fronted failed to remove:", f, err2)
-		}
+		s.reject(f, err, host)
 		return err
 	}
+	if s.cfg.CheckContent {
+		if err := s.checkContent(f); err != nil {
+			log.Println("server: content check failed:", f, err)
+			s.reject(f, err, host)
+			return err
+		}
+	}
 	if err := s.db.Add(f); err != nil {
 		log.Println("server: db fail:", f, err)
 		return err
 	}
+	s.emit(Event{Type: EventAdded, File: f, Bytes: f.Size})
 	return nil
 }
 
+// checkContent validates declared type and resolution of file in frontend
+func (s *DefaultServer) checkContent(f File) error {
+	rc, err := s.frontend.Get(f)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return CheckContent(f, rc)
+}
+
+// reject moves file from frontend to quarantine, if enabled,
+// or just removes it
+func (s *DefaultServer) reject(f File, reason error, host string) {
+	if s.quarantine != nil {
+		rc, err := s.frontend.Get(f)
+		if err == nil {
+			_, err = s.quarantine.Add(f, rc, reason, host)
+			rc.Close()
+		}
+		if err != nil {
+			log.Println("server: failed to quarantine:", f, err)
+		}
+	}
+	if err := s.frontend.Remove(f); err != nil {
+		log.Println("server: fronted failed to remove:", f, err)
+	}
+}
+
 func (s *DefaultServer) eventLoop() {
 	log.Println("eventloop:", "started")
 	defer log.Println("eventloop:", "stopped")
@@ -313,37 +414,134 @@ func (s *DefaultServer) eventLoop() {
 
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
+	collected := time.Now()
 	for {
 		select {
-		case e, ok := <-s.events:
-			if !ok {
-				return
-			}
-			log.Println("event:", e)
-			s.stats.Process(e)
 		case <-s.stop:
 			return
 		case t := <-ticker.C:
-			s.stats.Uptime = t.Sub(s.stats.Started)
+			if s.quarantine != nil && t.Sub(collected) >= quarantineCollectInterval {
+				collected = t
+				if err := s.quarantine.Collect(); err != nil {
+					log.Println("eventloop:", "failed to collect quarantine:", err)
+				}
+			}
+			load := s.measureLoad(t)
+			queued := int(atomic.LoadInt64(&s.queued))
+			s.stats.update(func(stats *Stats) {
+				stats.Uptime = t.Sub(stats.Started)
+				stats.Load = load
+				stats.DownloadsQueued = queued
+				if s.prefetcher != nil {
+					stats.Prefetch = s.prefetcher.Stats()
+				}
+			})
 		}
 	}
 }
 
+// proxy sends file to user while downloading it from hath network;
+// concurrent requests of same file share single download
 func (s *DefaultServer) proxy(c *gin.Context, f File, token string, galleryID, page int, filename string) {
 	log.Println("proxy:", f)
+	start := time.Now()
+	d, started := s.downloads.acquire(f)
+	defer d.leave()
+	if started {
+		s.tasks.Add(1)
+		go s.fetch(d, f, token, galleryID, page, filename)
+	} else {
+		log.Println("proxy:", "joining in-flight download of", f)
+	}
 
+	if err := d.wait(c.Request.Context()); err != nil {
+		c.String(http.StatusInternalServerError, "failed to download")
+		log.Println("proxy:", "failed to download", f, err)
+		s.emitRequest(c, Event{Type: EventError, File: f, Error: err.Error()}, start)
+		return
+	}
+	// proxying data without waiting for download to complete
+	c.Writer.Header().Add(headerContentLength, sInt64(f.Size))
+	c.Writer.Header().Add(headerContentType, f.ContentType())
+	n, err := io.CopyN(c.Writer, d.NewReader(c.Request.Context()), f.Size)
+	if err != nil || n != f.Size {
+		log.Println("proxy: failed", err)
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		s.emitRequest(c, Event{Type: EventError, File: f, Error: err.Error()}, start)
+		// headers are already sent, so closing connection
+		// to prevent user from treating response as complete
+		abort(c.Writer)
+		return
+	}
+	s.emitRequest(c, Event{Type: EventSent, File: f}, start)
+}
+
+// receive copies file from upstream to download, verifying its sha1
+func receive(d *download, f File, r io.Reader) error {
+	h := sha1.New()
+	n, err := io.CopyN(io.MultiWriter(d, h), r, f.Size)
+	if err == io.EOF || (err == nil && n != f.Size) {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), f.Hash[:]) {
+		return ErrFileInconsistent
+	}
+	return nil
+}
+
+// abort closes connection of response without completing it
+func abort(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		log.Println("server:", "failed to abort connection:", err)
+		return
+	}
+	conn.Close()
+}
+
+// requestURL returns url of file on request server
+func (s *DefaultServer) requestURL(f File, token string, galleryID, page int, filename string) *url.URL {
 	u := new(url.URL)
-	u.Scheme = downloadScheme
-	u.Host = s.cfg.Settings.RequestServer
+	u.Scheme = s.api.DownloadScheme()
+	u.Host = s.settings().RequestServer
 	u.Path = fmt.Sprintf("/r/%s/%s/%d-%d/%s", f, token, galleryID, page, filename)
+	return u
+}
+
+// fetch downloads file from hath network into in-flight download,
+// then saves it to cache/db and registers it
+func (s *DefaultServer) fetch(d *download, f File, token string, galleryID, page int, filename string) {
+	defer s.tasks.Done()
 
+	start := time.Now()
+	u := s.requestURL(f, token, galleryID, page, filename)
+	fail := func(err error) {
+		// failed on-demand downloads are retried later
+		if d.ctx.Err() == nil && s.settings().StaticRanges.Contains(f) {
+			s.enqueue(f, nil, err)
+		}
+		s.downloads.remove(f, d)
+		d.finish(err)
+		s.emit(Event{Type: EventError, File: f, Duration: time.Since(start), Error: err.Error()})
+	}
 	var downloadFromHathNetwork bool
-	var downloaded bool
 	for attempt := 1; attempt <= s.cfg.MaxDownloadAttemps; attempt++ {
 		downloadFromHathNetwork = attempt != s.cfg.MaxDownloadAttemps
 
 		// skip download from hath network
+		source := "hath"
 		if !downloadFromHathNetwork {
+			source = "direct"
+			s.metrics.Add("hath_proxy_fallbacks_total", 1)
 			log.Println("proxy: falling back to direct download")
 			q := make(url.Values)
 			q.Add("nl", "1") // so fucking obvious
@@ -351,52 +549,56 @@ func (s *DefaultServer) proxy(c *gin.Context, f File, token string, galleryID, p
 		}
 
 		log.Println("proxy:", "downloading", f)
+		s.metrics.Add("hath_proxy_attempts_total", 1, source)
 
-		rc, err := s.api.RequestFile(f, u)
+		rc, err := s.api.RequestFileContext(d.ctx, f, u)
+		if err == nil {
+			err = receive(d, f, rc)
+			rc.Close()
+		}
 		if err != nil {
 			log.Println("proxy: download attempt failed", err)
+			if err == ErrFileInconsistent && s.quarantine != nil {
+				if _, qErr := s.quarantine.Add(f, bytes.NewReader(d.Bytes()), err, u.Host); qErr != nil {
+					log.Println("proxy: failed to quarantine:", f, qErr)
+				}
+			}
+			if d.ctx.Err() != nil {
+				log.Println("proxy: request canceled")
+				fail(err)
+				return
+			}
+			// retrying is possible only if no data was sent to users
+			if !d.reset() {
+				fail(err)
+				return
+			}
 			continue
 		}
-		defer rc.Close()
-
-		buff := f.Buffer()
-		w := io.MultiWriter(buff, c.Writer)
-		// proxying data without buffering for speed-up
-		c.Writer.Header().Add(headerContentLength, sInt64(f.Size))
-		c.Writer.Header().Add(headerContentType, f.ContentType())
+		d.finish(nil)
+		s.emit(Event{Type: EventDownloaded, File: f, Bytes: f.Size, Duration: time.Since(start)})
+		log.Println("proxy:", "downloaded", f)
 
-		n, err := io.CopyN(w, rc, f.Size)
-		if err != nil || n != f.Size {
-			log.Println("proxy: failed", err)
+		// saving file to db/frontend while new requests still
+		// join completed download instead of starting new one
+		defer s.downloads.remove(f, d)
+		log.Println("proxy:", "saving file to cache/db")
+		if err := s.addFile(f, bytes.NewReader(d.Bytes()), u.Host); err != nil {
+			log.Println("proxy:", "add failed", err)
+			s.emit(Event{Type: EventError, File: f, Error: err.Error()})
 			return
 		}
-		// async saving file to db/frontend
-		go func() {
-			defer buff.Reset()
-			log.Println("proxy:", "saving file to cache/db")
-			if err := s.addFile(f, buff); err != nil {
-				log.Println("proxy:", "add failed", err)
-				return
-			}
-			s.registerQuery <- f
-			log.Println("proxy:", "cached", f)
-		}()
-		s.events <- Event{EventDownloaded, f}
-		s.events <- Event{EventSent, f}
-		downloaded = true
-		break
-	}
-	if downloaded {
-		log.Println("proxy:", "downloaded", f)
-	} else {
-		c.String(http.StatusInternalServerError, "failed to download")
-		log.Println("proxy:", "failed to download", f)
+		s.register(f)
+		log.Println("proxy:", "cached", f)
+		return
 	}
+	log.Println("proxy:", "failed to download", f)
+	fail(ErrDownloadFailed)
 }
 
 // handleProxy /p/fileid=asdf;token=asdf;gid=123;page=321;passkey=asdf/filename
 func (s *DefaultServer) handleProxy(c *gin.Context) {
-	mode := s.cfg.Settings.ProxyMode
+	mode := s.settings().ProxyMode
 	if mode == ProxyDisabled {
 		c.String(http.StatusForbidden, "proxy disabled")
 		return
@@ -417,8 +619,11 @@ func (s *DefaultServer) handleProxy(c *gin.Context) {
 
 	if s.db.Exists(f) {
 		log.Println("proxy:", "file already exists; serving from cache", f)
+		s.prefetchHit(f)
+		s.prefetch(f, galleryID, page)
+		start := time.Now()
 		s.frontend.Handle(f, c.Writer)
-		s.events <- Event{EventSent, f}
+		s.emitRequest(c, Event{Type: EventSent, File: f}, start)
 		return
 	}
 
@@ -429,14 +634,7 @@ func (s *DefaultServer) handleProxy(c *gin.Context) {
 			c.String(http.StatusInternalServerError, "unable to parse ip")
 			return
 		}
-		var isLocal bool
-		for _, net := range LocalNetworks {
-			if net.Contains(ip) {
-				isLocal = true
-				break
-			}
-		}
-		if !isLocal {
+		if !IsLocal(ip) {
 			log.Println("proxy:", "access from non-local network by", ip, "<-", c.Request.RemoteAddr)
 			c.String(http.StatusForbidden, "bad ip")
 			return
@@ -452,11 +650,13 @@ func (s *DefaultServer) handleProxy(c *gin.Context) {
 		}
 	}
 
+	s.prefetch(f, galleryID, page)
 	s.proxy(c, f, token, galleryID, page, filename)
 }
 
 // handleImage /h/<fileid>/<additional:kwds>/<filename>
 func (s *DefaultServer) handleImage(c *gin.Context) {
+	start := time.Now()
 	fileID := c.Param("fileid")
 	filename := c.Param("filename")
 	log.Println("server:", "serving", fileID)
@@ -492,24 +692,28 @@ func (s *DefaultServer) handleImage(c *gin.Context) {
 	}
 	expectedKeyStamp := f.KeyStamp(s.cfg.Key, timestamp)
 	if expectedKeyStamp != keyStamp && !s.cfg.DontCheckSHA1 {
+		s.metrics.Add("hath_keystamp_failures_total", 1)
 		c.String(http.StatusForbidden, "403: bad keystamp")
+		s.emitRequest(c, Event{Type: EventError, File: f, Error: "bad keystamp"}, start)
 		return
 	}
+	s.prefetch(f, args.GetInt("gid"), args.GetInt("page"))
 	if s.db.Exists(f) {
+		s.prefetchHit(f)
 		s.frontend.Handle(f, c.Writer)
-		s.useQuery <- f
-		s.events <- Event{EventSent, f}
+		s.use(f)
+		s.emitRequest(c, Event{Type: EventSent, File: f}, start)
 		log.Println("server:", "served", f, "to", ip)
 		return
 	}
-	if !s.cfg.Settings.StaticRanges.Contains(f) {
+	if !s.settings().StaticRanges.Contains(f) {
 		log.Println("server:", "not found", f)
 		c.String(http.StatusNotFound, "404: not found")
 		return
 	}
 
 	log.Println("server:", "downloading file from static range", f.Range())
-	tokens, err := s.api.Tokens([]File{f})
+	tokens, err := s.api.TokensContext(c.Request.Context(), []File{f})
 	if err != nil {
 		log.Println("server:", "failed to get tokens for file:", err)
 	}
@@ -541,7 +745,7 @@ func (s *DefaultServer) isDeltaValid(ts string) bool {
 		log.Println("server:", "timestamp check failed", err)
 		return false
 	}
-	delta := time.Now().Unix() - timestamp
+	delta := s.api.Now().Unix() - timestamp
 	if delta < 0 {
 		delta *= -1
 	}
@@ -571,6 +775,10 @@ func (s *DefaultServer) removeUnused(deadline time.Time) error {
 	if err := s.db.RemoveBatch(files); err != nil {
 		return err
 	}
+	s.metrics.Add("hath_evictions_total", float64(len(files)))
+	for _, f := range files {
+		s.emit(Event{Type: EventEvicted, File: f, Bytes: f.Size})
+	}
 	if err := s.frontend.RemoveBatch(files); err != nil {
 		return err
 	}
@@ -630,8 +838,9 @@ func (s *DefaultServer) removeLoop() {
 			}
 			log.Println("server:", "files to remove:", count)
 			s.updateLock.Lock()
-			defer s.updateLock.Unlock()
-			if err := s.removeAllUnused(deadline); err != nil {
+			err = s.removeAllUnused(deadline)
+			s.updateLock.Unlock()
+			if err != nil {
 				log.Println("error while removing files", err)
 			} else {
 				log.Println("server:", "removed", count)
@@ -646,7 +855,7 @@ func (s *DefaultServer) removeLoop() {
 func (s *DefaultServer) handleCommand(c *gin.Context) {
 	// checking remote ip
 	log.Println("command:", c.Request.URL.Path)
-	if !s.cfg.Settings.IsRPCServer(c.Request) {
+	if !s.settings().IsRPCServer(c.Request) {
 		log.Println("server:", "got request from suspicous origin", c.Request.RemoteAddr)
 		if !s.cfg.Debug {
 			c.String(http.StatusUnauthorized, "401: not authorised")
@@ -704,48 +913,6 @@ func (s *DefaultServer) commandSpeedTest(c *gin.Context, args Args) {
 	}
 }
 
-// commandDownload process request from server to download a list of files
-// and store them in database and cache
-func (s *DefaultServer) commandDownload(c *gin.Context, args Args) {
-	for fileInfo, key := range args {
-		elems := strings.Split(fileInfo, fileInfoDelimiter)
-		if len(elems) != 2 {
-			log.Println("warning:", "got bad file info string from server:", fileInfo)
-			continue
-		}
-		fileID := elems[0]
-		host := elems[1]
-
-		writeStatus := func(status string) {
-			fmt.Fprintf(c.Writer, "%s:%s\n", fileID, status)
-		}
-
-		// parsing and validating fileID
-		f, err := FileFromID(fileID)
-		if err != nil {
-			writeStatus(downloadInvalid)
-			continue
-		}
-
-		// generating url
-		u := new(url.URL)
-		u.Host = host
-		u.Scheme = downloadScheme
-		u.Path = downloadPath
-		q := make(url.Values)
-		q.Add(argDownloadFileID, fileID)
-		q.Add(argDownloadKey, key)
-		u.RawQuery = q.Encode()
-
-		// downloading and saving file to db/cache
-		if err := s.addFromURL(f, u); err != nil {
-			writeStatus(downloadError)
-			continue
-		}
-		writeStatus(downloadSuccess)
-	}
-}
-
 // commandRefreshSettings precesses request to refresh settings
 func (s *DefaultServer) commandRefreshSettings(c *gin.Context, args Args) {
 	if err := s.refreshSettings(); err != nil {
@@ -755,6 +922,13 @@ func (s *DefaultServer) commandRefreshSettings(c *gin.Context, args Args) {
 	c.String(http.StatusOK, "true")
 }
 
+// settings returns current settings from rpc server
+func (s *DefaultServer) settings() Settings {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	return s.cfg.Settings
+}
+
 func (s *DefaultServer) refreshSettings() error {
 	log.Println("server:", "refreshing settings")
 	settings, err := s.api.Settings()
@@ -762,7 +936,13 @@ func (s *DefaultServer) refreshSettings() error {
 		log.Println("server:", "failed to refresh settings", err)
 		return err
 	}
+	s.settingsLock.Lock()
 	s.cfg.Settings = settings
+	s.settingsLock.Unlock()
+	s.limiter.SetRate(settings.MaximumBytesPerSecond)
+	if s.prefetcher != nil {
+		s.prefetcher.setRate(s.downloadRate())
+	}
 	log.Println("server:", "refreshed settings")
 	return err
 }
@@ -790,8 +970,11 @@ func (s *DefaultServer) commandProxyTest(c *gin.Context, args Args) {
 	}
 	// generating url
 	u := new(url.URL)
-	u.Scheme = downloadScheme
+	u.Scheme = s.api.DownloadScheme()
 	u.Host = ip.String()
+	if port != 0 {
+		u.Host = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	}
 	u.Path = fmt.Sprintf("/h/%s/keystamp=%s/test.jpg", fileID, keystamp)
 	log.Printf("proxy: testing %s:%d", ip, port)
 
@@ -799,7 +982,7 @@ func (s *DefaultServer) commandProxyTest(c *gin.Context, args Args) {
 	buff := f.Buffer()
 
 	// starting request
-	rc, err := s.api.GetFile(u)
+	rc, err := s.api.GetFileContext(c.Request.Context(), u)
 	if err != nil {
 		writeStatus(downloadError, 0)
 		return
@@ -826,7 +1009,7 @@ func (s *DefaultServer) commandProxyTest(c *gin.Context, args Args) {
 	// db interactions, possible frontend speed degradation, etc.
 	// There is no sense to calculate possible RTT impact here
 	duration := time.Now().Sub(start)
-	if err := s.addFile(f, buff); err != nil {
+	if err := s.addFile(f, buff, u.Host); err != nil {
 		// possible sha1 checksum fail
 		log.Println("proxy: failed to add  file", err)
 		writeStatus(downloadError, 0)
@@ -862,12 +1045,12 @@ func (s *DefaultServer) commandThreadedProxyTest(c *gin.Context, args Args) {
 
 	u := new(url.URL)
 	u.Host = fmt.Sprintf("%s:%d", ip, port)
-	u.Scheme = downloadScheme
+	u.Scheme = s.api.DownloadScheme()
 
 	for attempt := 0; attempt < count; attempt++ {
 		u.Path = fmt.Sprintf("/t/%d/%d/%s/%d", size, timestamp, key, rand.Int())
 		go func(workerURL url.URL) {
-			rc, err := s.api.GetFile(&workerURL)
+			rc, err := s.api.GetFileContext(c.Request.Context(), &workerURL)
 			if err != nil {
 				results <- Result{err: err}
 				return
@@ -943,7 +1126,114 @@ func (s *DefaultServer) proxyTest(c *gin.Context) {
 }
 
 func (s *DefaultServer) handleStats(c *gin.Context) {
-	c.JSON(http.StatusOK, s.stats)
+	c.JSON(http.StatusOK, s.Stats())
+}
+
+// handleStatsHistory returns statistics with rolling windows
+// GET /api/stats/history
+func (s *DefaultServer) handleStatsHistory(c *gin.Context) {
+	c.JSON(http.StatusOK, s.StatsSnapshot())
+}
+
+// Stats returns copy of server statistics
+func (s *DefaultServer) Stats() Stats {
+	return s.stats.get()
+}
+
+// StatsSnapshot returns copy of server statistics with
+// counters of last minute, hour and day
+func (s *DefaultServer) StatsSnapshot() StatsSnapshot {
+	return s.stats.snapshot(time.Now())
+}
+
+// handleQuarantineList returns quarantine entries and per-host counts
+// GET /api/quarantine?host=<host>
+func (s *DefaultServer) handleQuarantineList(c *gin.Context) {
+	if s.quarantine == nil {
+		c.String(http.StatusNotFound, "404: quarantine disabled")
+		return
+	}
+	entries, err := s.quarantine.List()
+	if err != nil {
+		log.Println("quarantine:", "failed to list", err)
+		c.String(http.StatusInternalServerError, "500: failed to list")
+		return
+	}
+	host := c.Query("host")
+	hosts := make(map[string]int)
+	result := make([]gin.H, 0, len(entries))
+	for _, e := range entries {
+		hosts[e.Host]++
+		if len(host) != 0 && e.Host != host {
+			continue
+		}
+		result = append(result, gin.H{"id": e.ID(), "entry": e})
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": result, "hosts": hosts})
+}
+
+// handleQuarantineGet returns quarantine entry
+// GET /api/quarantine/:id
+func (s *DefaultServer) handleQuarantineGet(c *gin.Context) {
+	if s.quarantine == nil {
+		c.String(http.StatusNotFound, "404: quarantine disabled")
+		return
+	}
+	e, err := s.quarantine.Get(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusNotFound, "404: not found")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": e.ID(), "entry": e})
+}
+
+// handleQuarantinePayload sends payload of quarantine entry as is
+// GET /api/quarantine/:id/payload
+func (s *DefaultServer) handleQuarantinePayload(c *gin.Context) {
+	if s.quarantine == nil {
+		c.String(http.StatusNotFound, "404: quarantine disabled")
+		return
+	}
+	rc, err := s.quarantine.Open(c.Param("id"))
+	if err != nil {
+		c.String(http.StatusNotFound, "404: not found")
+		return
+	}
+	defer rc.Close()
+	c.Writer.Header().Add(headerContentType, ContentTypes[UnknownImage])
+	if _, err := io.Copy(c.Writer, rc); err != nil {
+		log.Println("quarantine:", "failed to send payload", err)
+	}
+}
+
+// handleQuarantineRemove deletes quarantine entry
+// DELETE /api/quarantine/:id
+func (s *DefaultServer) handleQuarantineRemove(c *gin.Context) {
+	if s.quarantine == nil {
+		c.String(http.StatusNotFound, "404: quarantine disabled")
+		return
+	}
+	if err := s.quarantine.Remove(c.Param("id")); err != nil {
+		c.String(http.StatusNotFound, "404: not found")
+		return
+	}
+	c.String(http.StatusOK, "OK")
+}
+
+// handleQuarantinePurge deletes all quarantine entries
+// DELETE /api/quarantine
+func (s *DefaultServer) handleQuarantinePurge(c *gin.Context) {
+	if s.quarantine == nil {
+		c.String(http.StatusNotFound, "404: quarantine disabled")
+		return
+	}
+	count, err := s.quarantine.Purge()
+	if err != nil {
+		log.Println("quarantine:", "failed to purge", err)
+		c.String(http.StatusInternalServerError, "500: failed to purge")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removed": count})
 }
 
 // commandList returns list of files in ache
@@ -999,11 +1289,37 @@ func (s *DefaultServer) useLoop() {
 		case <-ticker.C:
 			update()
 		case <-s.stop:
-			return
+			// draining query
+			for {
+				select {
+				case f := <-s.useQuery:
+					files = append(files, f)
+				default:
+					return
+				}
+			}
 		}
 	}
 }
 
+// use queues update of last usage of file,
+// file is dropped if server is stopped
+func (s *DefaultServer) use(f File) {
+	select {
+	case s.useQuery <- f:
+	case <-s.stop:
+	}
+}
+
+// register queues registration of file in rpc server,
+// file is dropped if server is stopped
+func (s *DefaultServer) register(f File) {
+	select {
+	case s.registerQuery <- f:
+	case <-s.stop:
+	}
+}
+
 // file register loop
 func (s *DefaultServer) registerLoop() {
 	defer s.wg.Done()
@@ -1016,37 +1332,54 @@ func (s *DefaultServer) registerLoop() {
 			return
 		}
 		if err := s.api.AddFiles(files); err != nil {
+			// keeping files to register them on next update
 			log.Println("api: failed to add files:", err)
-		} else {
-			log.Println("api:", "registered files:", len(files))
+			return
 		}
+		log.Println("api:", "registered files:", len(files))
 		files = nil
 	}
 	// we need to register last files before stopping server
 	defer update()
+	add := func(f File) {
+		// not registering files from static range
+		if s.settings().StaticRanges.Contains(f) {
+			return
+		}
+		if len(files) >= registerPendingMax {
+			// dropping oldest file to bound memory on long rpc outage
+			log.Println("api:", "too many pending files, not registering", files[0])
+			files = files[1:]
+		}
+		files = append(files, f)
+	}
 	for {
 		select {
 		case f := <-s.registerQuery:
-			// not registering files from static range
-			if s.cfg.Settings.StaticRanges.Contains(f) {
-				continue
-			}
-			files = append(files, f)
+			add(f)
 		case <-ticker.C:
 			update()
 		case <-s.stop:
-			return
+			// draining query
+			for {
+				select {
+				case f := <-s.registerQuery:
+					add(f)
+				default:
+					return
+				}
+			}
 		}
 	}
 }
 
-func (s *DefaultServer) addFromURL(f File, u *url.URL) error {
-	rc, err := s.api.GetFile(u)
+func (s *DefaultServer) addFromURL(ctx context.Context, f File, u *url.URL) error {
+	rc, err := s.api.GetFileContext(ctx, u)
 	if err != nil {
 		return err
 	}
 	defer rc.Close()
-	return s.addFile(f, rc)
+	return s.addFile(f, NewLimitedReader(rc, s.downloadLimiter), u.Host)
 }
 
 // Start server internal goroutines
@@ -1062,9 +1395,25 @@ func (s *DefaultServer) Start() error {
 		}
 	}
 
-	s.stats.FilesTotal = s.db.Count()
-	s.stats.Started = time.Now()
-	s.stats.Uptime = 0
+	s.loadStats()
+	// cache totals are counted once and then updated by events
+	filesTotal := s.db.Count()
+	filesTotalBytes, err := s.db.Size()
+	if err != nil {
+		log.Println("server:", "failed to get cache size:", err)
+	}
+	s.stats.update(func(stats *Stats) {
+		stats.FilesTotal = filesTotal
+		stats.FilesTotalBytes = filesTotalBytes
+		stats.Started = time.Now()
+		stats.Uptime = 0
+	})
+
+	if s.certificates != nil {
+		if err := s.certificates.reload(); err != nil {
+			return err
+		}
+	}
 
 	s.stop = make(chan bool)
 	go s.stopNotificator()
@@ -1089,6 +1438,41 @@ func (s *DefaultServer) Start() error {
 	s.wg.Add(1)
 	go s.registerLoop()
 
+	// starting blacklist sync loop
+	s.wg.Add(1)
+	go s.blacklistLoop()
+
+	// starting stats checkpoint loop
+	s.wg.Add(1)
+	go s.statsLoop()
+
+	// starting download queue loop
+	s.wg.Add(1)
+	go s.queueLoop()
+
+	// starting cache_files download workers
+	for i := 0; i < s.cfg.DownloadWorkers; i++ {
+		s.wg.Add(1)
+		go s.downloadWorker()
+	}
+
+	if s.prefetcher != nil {
+		// starting gallery prefetch loop
+		s.wg.Add(1)
+		go s.prefetchLoop()
+	}
+
+	if s.certificates != nil {
+		// starting certificate reload loop
+		s.wg.Add(1)
+		go s.certificateLoop()
+	}
+
+	// files are served only after server is completely started
+	s.stateLock.Lock()
+	s.state = StateRunning
+	s.stateLock.Unlock()
+
 	s.started = true
 	log.Println("server:", "started")
 	return nil
@@ -1096,7 +1480,13 @@ func (s *DefaultServer) Start() error {
 
 // Listen on confgured port
 func (s *DefaultServer) Listen() error {
-	addr := fmt.Sprintf(":%d", s.cfg.Settings.Port)
+	addr := fmt.Sprintf(":%d", s.settings().Port)
+	// listener is opened before start notification, so
+	// rpc server is not notified if port is not available
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
 	go func() {
 		maxRetries := 3
 		for attempt := 0; attempt < maxRetries; attempt++ {
@@ -1118,7 +1508,20 @@ func (s *DefaultServer) Listen() error {
 		log.Fatalln("client:", "failed to register in hath network")
 	}()
 	log.Println("server:", "listening on", addr)
-	return http.ListenAndServe(addr, s)
+	httpServer := &http.Server{Addr: addr, Handler: s, ConnContext: s.connContext}
+	s.stateLock.Lock()
+	s.httpServer = httpServer
+	s.stateLock.Unlock()
+	if s.certificates != nil {
+		httpServer.TLSConfig = s.certificates.TLSConfig()
+		err = httpServer.ServeTLS(ln, "", "")
+	} else {
+		err = httpServer.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
 
 func (s *DefaultServer) stopNotificator() {
@@ -1130,7 +1533,7 @@ const progressChannelSize = 20
 const populateBatchSize = 10000
 
 // PopulateFromFrontend scans frontend and adds all files in it to database
-func (s DefaultServer) PopulateFromFrontend() error {
+func (s *DefaultServer) PopulateFromFrontend() error {
 	files := make(chan File)
 	progress := make(chan Progress, progressChannelSize)
 	go func() {
@@ -1168,21 +1571,51 @@ func (s DefaultServer) PopulateFromFrontend() error {
 	return nil
 }
 
-// Close stops server
+// Close stops server gracefully: notifies rpc server,
+// stops accepting connections, waits for in-flight transfers
+// up to ShutdownTimeout, flushes use/register batches and
+// only then closes database
 func (s *DefaultServer) Close() error {
 	if !s.started {
 		return nil
 	}
-	close(s.useQuery)
-	close(s.registerQuery)
-	close(s.events)
-	close(s.stop)
-	s.wg.Wait()
-
+	s.setStopping()
 	if err := s.api.Close(); err != nil {
 		log.Println("server:", "close notification failed", err)
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+	s.stateLock.Lock()
+	httpServer := s.httpServer
+	s.stateLock.Unlock()
+	if httpServer != nil {
+		log.Println("server:", "draining connections")
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Println("server:", "failed to drain connections:", err)
+		}
+	}
+	// waiting for background tasks that can send to queries
+	tasksDone := make(chan struct{})
+	go func() {
+		s.tasks.Wait()
+		close(tasksDone)
+	}()
+	select {
+	case <-tasksDone:
+	case <-ctx.Done():
+		log.Println("server:", "background tasks are not finished in time")
+	}
+
+	// loops are flushing queries on stop
+	close(s.stop)
+	s.wg.Wait()
+
+	// statistics are saved after all loops and tasks,
+	// so events emitted by them are not lost
+	if err := s.saveStats(time.Now()); err != nil {
+		log.Println("server:", "failed to save stats:", err)
+	}
 	s.db.Close()
 	s.started = false
 	log.Println("server:", "stopped")
@@ -1203,6 +1636,71 @@ type ServerConfig struct {
 	MaxDownloadAttemps  int
 	Settings            Settings
 	Debug               bool
+
+	// QuarantineDir is directory for corrupt or rejected files,
+	// quarantine is disabled if empty
+	QuarantineDir        string
+	QuarantineMaxEntries int
+	QuarantineMaxAge     time.Duration
+
+	// CheckContent enables sniffing of file type and decoding
+	// of image headers before adding file to cache
+	CheckContent bool
+
+	// MaxConnectionBytesPerSecond limits bandwidth of single
+	// connection, no limit if zero
+	MaxConnectionBytesPerSecond int64
+
+	// RateLimit is per-ip connection and request rate limits
+	RateLimit RateLimitConfig
+
+	// Overload is limits of load, after which
+	// rpc server is notified of overload
+	Overload OverloadConfig
+
+	// ShutdownTimeout is maximum duration of connection draining on Close
+	ShutdownTimeout time.Duration
+
+	// QueueInterval is interval of retrying queued downloads
+	QueueInterval time.Duration
+	// QueueRetryBackoff is base delay between retries of queued download
+	QueueRetryBackoff time.Duration
+	// QueueMaxAttempts is count of attempts after which
+	// queued download is dropped
+	QueueMaxAttempts int
+
+	// StatsInterval is interval of saving statistics to database
+	StatsInterval time.Duration
+
+	// BlacklistInterval is interval of blacklist sync
+	BlacklistInterval time.Duration
+	// BlacklistRetention is how long removed files are listed in /api/blacklist
+	BlacklistRetention time.Duration
+
+	// DownloadWorkers is count of concurrent cache_files downloads
+	DownloadWorkers int
+	// DownloadTimeout is maximum duration of single download attempt
+	DownloadTimeout time.Duration
+	// DownloadRetries is count of retries of failed download,
+	// negative value disables retries
+	DownloadRetries int
+	// MaxDownloadBytesPerSecond limits total bandwidth of
+	// downloads to cache, no limit if zero
+	MaxDownloadBytesPerSecond int64
+
+	// MetricsToken allows access to /metrics from any network
+	// with token in query or bearer authorization header,
+	// only local networks are allowed if empty
+	MetricsToken string
+
+	// Prefetch is configuration of gallery page prefetching
+	Prefetch PrefetchConfig
+
+	// TLS enables serving over https with certificate issued by rpc server
+	TLS bool
+	// CertificateRenewBefore is duration before certificate expiration
+	// when it is reloaded from rpc server
+	CertificateRenewBefore time.Duration
 }
 
 // PopulateDefaults of the config
@@ -1222,6 +1720,57 @@ func (cfg *ServerConfig) PopulateDefaults() {
 	if cfg.MaxDownloadAttemps == 0 {
 		cfg.MaxDownloadAttemps = 4
 	}
+	if cfg.ShutdownTimeout == time.Second*0 {
+		cfg.ShutdownTimeout = time.Second * 30
+	}
+	if cfg.Overload.Threshold == 0 {
+		cfg.Overload.Threshold = 0.9
+	}
+	if cfg.Overload.NotifyInterval == time.Second*0 {
+		cfg.Overload.NotifyInterval = time.Minute
+	}
+	if cfg.Overload.MaxUsageQueue == 0 {
+		cfg.Overload.MaxUsageQueue = useQuerySize
+	}
+	if cfg.BlacklistInterval == time.Second*0 {
+		cfg.BlacklistInterval = time.Hour
+	}
+	if cfg.BlacklistRetention == time.Second*0 {
+		cfg.BlacklistRetention = time.Hour * 24 * 30
+	}
+	if cfg.DownloadWorkers == 0 {
+		cfg.DownloadWorkers = 4
+	}
+	if cfg.DownloadTimeout == time.Second*0 {
+		cfg.DownloadTimeout = time.Minute * 2
+	}
+	if cfg.DownloadRetries == 0 {
+		cfg.DownloadRetries = 2
+	}
+	if cfg.StatsInterval == time.Second*0 {
+		cfg.StatsInterval = time.Minute * 5
+	}
+	if cfg.QueueInterval == time.Second*0 {
+		cfg.QueueInterval = time.Minute
+	}
+	if cfg.QueueRetryBackoff == time.Second*0 {
+		cfg.QueueRetryBackoff = time.Minute
+	}
+	if cfg.QueueMaxAttempts == 0 {
+		cfg.QueueMaxAttempts = 10
+	}
+	if cfg.Prefetch.Pages == 0 {
+		cfg.Prefetch.Pages = 3
+	}
+	if cfg.Prefetch.Budget == 0 {
+		cfg.Prefetch.Budget = 32
+	}
+	if cfg.Prefetch.BandwidthShare <= 0 || cfg.Prefetch.BandwidthShare > 1 {
+		cfg.Prefetch.BandwidthShare = 0.25
+	}
+	if cfg.CertificateRenewBefore == time.Second*0 {
+		cfg.CertificateRenewBefore = time.Hour * 72
+	}
 }
 
 var (
@@ -1229,6 +1778,27 @@ var (
 	LocalNetworks []net.IPNet
 )
 
+// IsLocal returns true if ip is from one of LocalNetworks
+func IsLocal(ip net.IP) bool {
+	for _, n := range LocalNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// localOnly aborts requests from non-local networks
+func localOnly(c *gin.Context) {
+	ip, err := FromRequest(c.Request)
+	if err != nil || !IsLocal(ip) {
+		c.String(http.StatusForbidden, "403: local access only")
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
 func init() {
 	localNetworks := []string{
 		"10.0.0.0/8",
@@ -1251,7 +1821,8 @@ func NewServer(cfg ServerConfig) *DefaultServer {
 	cfg.PopulateDefaults()
 	s := new(DefaultServer)
 	s.cfg = cfg
-	s.db = cfg.DataBase
+	s.metrics = NewMetrics()
+	s.db = metricsDB{cfg.DataBase, s.metrics}
 	s.frontend = cfg.Frontend
 
 	// config init
@@ -1273,13 +1844,40 @@ func NewServer(cfg ServerConfig) *DefaultServer {
 	e := gin.New()
 	e.Use(gin.Logger())
 	e.Use(gin.Recovery())
+	e.Use(s.instrument)
+
+	// rate limits are applied only to file requests, so
+	// server commands, api and metrics are never limited
+	files := e.Group("")
+	if cfg.RateLimit.Enabled() {
+		s.rateLimiter = newRateLimiter(cfg.RateLimit)
+		files.Use(s.rateLimit)
+	}
 
 	// routing init
-	e.GET("/h/:fileid/:kwds/:filename", s.handleImage)
+	files.GET("/h/:fileid/:kwds/:filename", s.trackLoad, s.checkRunning, s.throttle, s.handleImage)
+	files.GET("/p/:kwds/:filename", s.trackLoad, s.throttle, s.handleProxy)
 	e.GET("/servercmd/:command/:kwds/:timestamp/:key", s.handleCommand)
-	e.GET("/p/:kwds/:filename", s.handleProxy)
-	e.GET("/t/:size/:timestamp/:key/:n", s.proxyTest)
+	e.GET("/t/:size/:timestamp/:key/:n", s.throttle, s.proxyTest)
 	e.GET("/api/stats", s.handleStats)
+	e.GET("/api/stats/history", s.handleStatsHistory)
+	e.GET("/api/blacklist", localOnly, s.handleBlacklist)
+	e.GET("/api/queue", localOnly, s.handleQueue)
+	e.GET("/metrics", s.metricsAuth, s.handleMetrics)
+
+	// quarantine api
+	q := e.Group("/api/quarantine", localOnly)
+	q.GET("", s.handleQuarantineList)
+	q.DELETE("", s.handleQuarantinePurge)
+	q.GET("/:id", s.handleQuarantineGet)
+	q.GET("/:id/payload", s.handleQuarantinePayload)
+	q.DELETE("/:id", s.handleQuarantineRemove)
+
+	// local administration
+	admin := e.Group("/api/admin", localOnly)
+	admin.GET("/state", s.handleAdminState)
+	admin.POST("/suspend", s.handleAdminSuspend)
+	admin.POST("/resume", s.handleAdminResume)
 	e.GET("/favicon.ico", func(c *gin.Context) {
 		c.Redirect(http.StatusMovedPermanently, "http://g.e-hentai.org/favicon.ico")
 	})
@@ -1303,9 +1901,35 @@ func NewServer(cfg ServerConfig) *DefaultServer {
 	s.useQuery = make(chan File, useQuerySize)
 	s.registerQuery = make(chan File)
 	s.wg = new(sync.WaitGroup)
-	s.api = cfg.Client
+	s.tasks = new(sync.WaitGroup)
+	s.downloads = newDownloads()
+	s.stats = newStatsCollector()
+	if cfg.Client != nil {
+		// client can be shared, so it is not modified
+		s.api = cfg.Client.instrumented(s.metrics, s.emitRPC)
+	}
 	s.stop = make(chan bool)
 	s.updateLock = new(sync.Mutex)
-	s.events = make(chan Event)
+	s.stateLock = new(sync.Mutex)
+	s.events = newEventBus()
+	s.limiter = NewLimiter(cfg.Settings.MaximumBytesPerSecond)
+	s.downloadLimiter = NewLimiter(cfg.MaxDownloadBytesPerSecond)
+	s.downloadJobs = make(chan downloadJob)
+	if cfg.Prefetch.Enabled {
+		s.prefetcher = newPrefetcher(cfg.Prefetch, s.downloadRate())
+	}
+	s.load = newLoadMonitor()
+	if cfg.TLS {
+		s.certificates = newCertificateManager(s.api, cfg.CertificateRenewBefore)
+	}
+
+	if len(cfg.QuarantineDir) != 0 {
+		quarantine, err := NewQuarantine(cfg.QuarantineDir, s.db, cfg.QuarantineMaxEntries, cfg.QuarantineMaxAge)
+		if err != nil {
+			log.Println("server:", "quarantine disabled:", err)
+		} else {
+			s.quarantine = quarantine
+		}
+	}
 	return s
 }
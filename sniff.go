@@ -0,0 +1,105 @@
+package hath
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"image"
+	"io"
+
+	// registering decoders for image.DecodeConfig
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+const (
+	// sniffLength is count of bytes that is enough to detect file type
+	sniffLength = 512
+)
+
+var (
+	// ErrFileTypeMismatch when sniffed type differs from declared
+	ErrFileTypeMismatch = errors.New("File type does not match declared type")
+	// ErrFileResolutionMismatch when decoded width or height differs from declared
+	ErrFileResolutionMismatch = errors.New("File resolution does not match declared resolution")
+)
+
+// magic is bytes at offset
+type magic struct {
+	offset int
+	data   []byte
+}
+
+func (m magic) match(head []byte) bool {
+	if len(head) < m.offset+len(m.data) {
+		return false
+	}
+	return bytes.Equal(head[m.offset:m.offset+len(m.data)], m.data)
+}
+
+// fileSignature is set of magic bytes that all should match for file type
+type fileSignature struct {
+	magic []magic
+	t     FileType
+}
+
+func (s fileSignature) match(head []byte) bool {
+	for _, m := range s.magic {
+		if !m.match(head) {
+			return false
+		}
+	}
+	return true
+}
+
+var fileSignatures = []fileSignature{
+	{[]magic{{0, []byte("\xff\xd8\xff")}}, JPG},
+	{[]magic{{0, []byte("\x89PNG\r\n\x1a\n")}}, PNG},
+	{[]magic{{0, []byte("GIF87a")}}, GIF},
+	{[]magic{{0, []byte("GIF89a")}}, GIF},
+	{[]magic{{0, []byte("RIFF")}, {8, []byte("WEBP")}}, WBP},
+	{[]magic{{0, []byte("\x1a\x45\xdf\xa3")}}, WBM},
+	{[]magic{{4, []byte("ftypavif")}}, AVF},
+	{[]magic{{4, []byte("ftypavis")}}, AVF},
+	{[]magic{{0, []byte("\xff\x0a")}}, JXL},
+	{[]magic{{0, []byte("\x00\x00\x00\x0cJXL \x0d\x0a\x87\x0a")}}, JXL},
+}
+
+// SniffFileType detects file type by magic bytes in head of file,
+// returns UnknownImage if type is not detected
+func SniffFileType(head []byte) FileType {
+	for _, s := range fileSignatures {
+		if s.match(head) {
+			return s.t
+		}
+	}
+	return UnknownImage
+}
+
+// CheckContent sniffs type of file content from r and decodes
+// image header, checking that type, width and height of content
+// are equal to declared in f
+func CheckContent(f File, r io.Reader) error {
+	br := bufio.NewReaderSize(r, sniffLength)
+	head, err := br.Peek(sniffLength)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	t := SniffFileType(head)
+	if t != f.Type {
+		return ErrFileTypeMismatch
+	}
+	// resolution is checked only for types with decoders in stdlib
+	switch t {
+	case JPG, PNG, GIF:
+		cfg, _, err := image.DecodeConfig(br)
+		if err != nil {
+			return err
+		}
+		if cfg.Width != f.Width || cfg.Height != f.Height {
+			return ErrFileResolutionMismatch
+		}
+	}
+	return nil
+}
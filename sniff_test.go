@@ -0,0 +1,65 @@
+package hath
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSniff(t *testing.T) {
+	Convey("Sniff", t, func() {
+		width, height := 64, 32
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		encoders := map[FileType]func(*bytes.Buffer) error{
+			JPG: func(b *bytes.Buffer) error { return jpeg.Encode(b, img, nil) },
+			PNG: func(b *bytes.Buffer) error { return png.Encode(b, img) },
+			GIF: func(b *bytes.Buffer) error { return gif.Encode(b, img, nil) },
+		}
+		for fileType, encode := range encoders {
+			buff := new(bytes.Buffer)
+			So(encode(buff), ShouldBeNil)
+			data := buff.Bytes()
+			f := File{Type: fileType, Width: width, Height: height, Size: int64(len(data))}
+			Convey(fileType.String(), func() {
+				So(SniffFileType(data), ShouldEqual, fileType)
+				So(f.SniffContentType(data), ShouldEqual, ContentTypes[fileType])
+				So(CheckContent(f, bytes.NewReader(data)), ShouldBeNil)
+				Convey("Resolution mismatch", func() {
+					f.Width++
+					So(CheckContent(f, bytes.NewReader(data)), ShouldEqual, ErrFileResolutionMismatch)
+				})
+				Convey("Type mismatch", func() {
+					f.Type = (f.Type + 1) % UnknownImage
+					So(CheckContent(f, bytes.NewReader(data)), ShouldEqual, ErrFileTypeMismatch)
+					So(f.SniffContentType(data), ShouldEqual, ContentTypes[fileType])
+				})
+			})
+		}
+		Convey("Signatures", func() {
+			signatures := map[FileType][]byte{
+				WBP: []byte("RIFF\x24\x00\x00\x00WEBPVP8 "),
+				WBM: []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01"),
+				AVF: []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00"),
+				JXL: []byte("\xff\x0a\xfa\x1f"),
+			}
+			for fileType, head := range signatures {
+				So(SniffFileType(head), ShouldEqual, fileType)
+				f := File{Type: fileType}
+				So(CheckContent(f, bytes.NewReader(head)), ShouldBeNil)
+			}
+			So(SniffFileType([]byte("RIFF\x24\x00\x00\x00WAVEfmt ")), ShouldEqual, UnknownImage)
+		})
+		Convey("Unknown", func() {
+			data := []byte("definitely not an image")
+			So(SniffFileType(data), ShouldEqual, UnknownImage)
+			f := File{Type: PNG}
+			So(f.SniffContentType(data), ShouldEqual, f.ContentType())
+			So(CheckContent(f, bytes.NewReader(data)), ShouldEqual, ErrFileTypeMismatch)
+		})
+	})
+}
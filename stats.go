@@ -0,0 +1,399 @@
+package hath
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statsMinuteSlots = 60
+	statsHourSlots   = 60
+	statsDaySlots    = 24
+
+	// statsHistoryDays is count of days in daily history
+	statsHistoryDays = 365
+	statsDay         = time.Hour * 24
+
+	// statsTotalsKey is key of checkpoint of totals and windows
+	statsTotalsKey = "totals"
+	// statsDayPrefix is prefix of keys of daily history points
+	statsDayPrefix = "day-"
+)
+
+// StatsPoint is counters of sent and downloaded files in period
+// that starts at Start
+type StatsPoint struct {
+	Start                time.Time
+	FilesSent            int64
+	FilesSentBytes       int64
+	FilesDownloaded      int64
+	FilesDownloadedBytes int64
+}
+
+// add adds counters of event to point
+func (p *StatsPoint) add(e Event) {
+	switch e.Type {
+	case EventSent:
+		p.FilesSent++
+		p.FilesSentBytes += e.File.Size
+	case EventDownloaded:
+		p.FilesDownloaded++
+		p.FilesDownloadedBytes += e.File.Size
+	}
+}
+
+// StatsWindow is rolling window of points with Slot duration,
+// points are ordered from oldest to current one
+type StatsWindow struct {
+	Slot   time.Duration
+	Points []StatsPoint
+}
+
+// Total returns sum of all points of window
+func (w StatsWindow) Total() (total StatsPoint) {
+	for _, p := range w.Points {
+		total.FilesSent += p.FilesSent
+		total.FilesSentBytes += p.FilesSentBytes
+		total.FilesDownloaded += p.FilesDownloaded
+		total.FilesDownloadedBytes += p.FilesDownloadedBytes
+	}
+	if len(w.Points) != 0 {
+		total.Start = w.Points[0].Start
+	}
+	return total
+}
+
+// StatsPeak is maximum rate per second and time when it was reached
+type StatsPeak struct {
+	Rate int64
+	Time time.Time
+}
+
+// update sets peak to rate if it is greater than current one
+func (p *StatsPeak) update(rate int64, t time.Time) {
+	if rate > p.Rate {
+		p.Rate = rate
+		p.Time = t
+	}
+}
+
+// StatsPeaks is peak rates of sent and downloaded files
+type StatsPeaks struct {
+	FilesSent            StatsPeak
+	FilesSentBytes       StatsPeak
+	FilesDownloaded      StatsPeak
+	FilesDownloadedBytes StatsPeak
+}
+
+// StatsSnapshot is consistent copy of statistics with rolling
+// windows for last minute, hour and day and daily history
+type StatsSnapshot struct {
+	Stats   Stats
+	Minute  StatsWindow
+	Hour    StatsWindow
+	Day     StatsWindow
+	Peaks   StatsPeaks
+	History []StatsPoint
+}
+
+// statsCheckpoint is persisted part of statistics,
+// it is stored as json so new fields can be added
+type statsCheckpoint struct {
+	Saved                time.Time
+	FilesSent            int
+	FilesSentBytes       int64
+	FilesDownloaded      int
+	FilesDownloadedBytes int64
+	Peaks                StatsPeaks
+	Hour                 []StatsPoint
+	Day                  []StatsPoint
+}
+
+// statsDayKey returns key of daily history point
+func statsDayKey(day time.Time) string {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(day.Unix()))
+	return statsDayPrefix + string(key)
+}
+
+// statsWindow is ring of points, every point is slot
+// of time that is truncated to slot duration
+type statsWindow struct {
+	slot   time.Duration
+	points []StatsPoint
+}
+
+func newStatsWindow(slot time.Duration, slots int) *statsWindow {
+	return &statsWindow{slot: slot, points: make([]StatsPoint, slots)}
+}
+
+// current returns point of slot of t, resetting it if it is outdated
+func (w *statsWindow) current(t time.Time) *StatsPoint {
+	start := t.Truncate(w.slot)
+	p := &w.points[int(start.UnixNano()/int64(w.slot))%len(w.points)]
+	if !p.Start.Equal(start) {
+		*p = StatsPoint{Start: start}
+	}
+	return p
+}
+
+// restore puts point to its slot if slot has no newer point
+func (w *statsWindow) restore(p StatsPoint) {
+	if p.Start.IsZero() {
+		return
+	}
+	slot := &w.points[int(p.Start.UnixNano()/int64(w.slot))%len(w.points)]
+	if !slot.Start.After(p.Start) {
+		*slot = p
+	}
+}
+
+// snapshot returns window of slots that end at now
+func (w *statsWindow) snapshot(now time.Time) StatsWindow {
+	result := StatsWindow{Slot: w.slot, Points: make([]StatsPoint, len(w.points))}
+	start := now.Truncate(w.slot).Add(-w.slot * time.Duration(len(w.points)-1))
+	for i := range result.Points {
+		t := start.Add(w.slot * time.Duration(i))
+		p := w.points[int(t.UnixNano()/int64(w.slot))%len(w.points)]
+		if !p.Start.Equal(t) {
+			p = StatsPoint{Start: t}
+		}
+		result.Points[i] = p
+	}
+	return result
+}
+
+// statsCollector is concurrent-safe collector of server statistics
+type statsCollector struct {
+	mu     sync.Mutex
+	stats  Stats
+	minute *statsWindow
+	hour   *statsWindow
+	day    *statsWindow
+	peaks  StatsPeaks
+	// history is daily points by unix time of day start
+	history map[int64]StatsPoint
+	// lastSaved is time of last successful checkpoint
+	lastSaved time.Time
+}
+
+func newStatsCollector() *statsCollector {
+	return &statsCollector{
+		minute:  newStatsWindow(time.Second, statsMinuteSlots),
+		hour:    newStatsWindow(time.Minute, statsHourSlots),
+		day:     newStatsWindow(time.Hour, statsDaySlots),
+		history: make(map[int64]StatsPoint),
+	}
+}
+
+// process updates statistics with event that happened at t
+func (c *statsCollector) process(e Event, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Process(e)
+	if e.Type != EventSent && e.Type != EventDownloaded {
+		return
+	}
+	c.hour.current(t).add(e)
+	c.day.current(t).add(e)
+	day := t.Truncate(statsDay)
+	p := c.history[day.Unix()]
+	p.Start = day
+	p.add(e)
+	c.history[day.Unix()] = p
+
+	// minute window has one second slots, so its
+	// current point is rate of current second
+	second := c.minute.current(t)
+	second.add(e)
+	c.peaks.FilesSent.update(second.FilesSent, second.Start)
+	c.peaks.FilesSentBytes.update(second.FilesSentBytes, second.Start)
+	c.peaks.FilesDownloaded.update(second.FilesDownloaded, second.Start)
+	c.peaks.FilesDownloadedBytes.update(second.FilesDownloadedBytes, second.Start)
+}
+
+// update calls f with locked statistics
+func (c *statsCollector) update(f func(s *Stats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f(&c.stats)
+}
+
+// get returns copy of statistics
+func (c *statsCollector) get() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// snapshot returns copy of statistics with windows that end at now
+func (c *statsCollector) snapshot(now time.Time) StatsSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	history := make([]StatsPoint, 0, len(c.history))
+	for _, p := range c.history {
+		history = append(history, p)
+	}
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Start.Before(history[j].Start)
+	})
+	return StatsSnapshot{
+		Stats:   c.stats,
+		Minute:  c.minute.snapshot(now),
+		Hour:    c.hour.snapshot(now),
+		Day:     c.day.snapshot(now),
+		Peaks:   c.peaks,
+		History: history,
+	}
+}
+
+// checkpoint returns records of totals and of daily points that
+// changed since last saved checkpoint and keys of expired days
+func (c *statsCollector) checkpoint(now time.Time) (records map[string][]byte, expired []string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	records = make(map[string][]byte)
+	records[statsTotalsKey], err = json.Marshal(statsCheckpoint{
+		Saved:                now,
+		FilesSent:            c.stats.FilesSent,
+		FilesSentBytes:       c.stats.FilesSentBytes,
+		FilesDownloaded:      c.stats.FilesDownloaded,
+		FilesDownloadedBytes: c.stats.FilesDownloadedBytes,
+		Peaks:                c.peaks,
+		Hour:                 c.hour.snapshot(now).Points,
+		Day:                  c.day.snapshot(now).Points,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	changed := c.lastSaved.Truncate(statsDay)
+	deadline := statsHistoryDeadline(now)
+	for _, p := range c.history {
+		if p.Start.Before(deadline) {
+			expired = append(expired, statsDayKey(p.Start))
+			continue
+		}
+		if p.Start.Before(changed) {
+			continue
+		}
+		if records[statsDayKey(p.Start)], err = json.Marshal(p); err != nil {
+			return nil, nil, err
+		}
+	}
+	return records, expired, nil
+}
+
+// saved marks checkpoint made at now as saved
+// and removes expired days from history
+func (c *statsCollector) saved(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastSaved = now
+	deadline := statsHistoryDeadline(now)
+	for day, p := range c.history {
+		if p.Start.Before(deadline) {
+			delete(c.history, day)
+		}
+	}
+}
+
+// statsHistoryDeadline returns start of oldest day of history at now
+func statsHistoryDeadline(now time.Time) time.Time {
+	return now.Truncate(statsDay).Add(-statsDay * (statsHistoryDays - 1))
+}
+
+// restore replaces totals, windows and history with saved records,
+// unknown records and days expired at now are ignored
+func (c *statsCollector) restore(records map[string][]byte, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deadline := statsHistoryDeadline(now)
+	for key, value := range records {
+		if strings.HasPrefix(key, statsDayPrefix) {
+			var p StatsPoint
+			if err := json.Unmarshal(value, &p); err != nil {
+				return err
+			}
+			if p.Start.Before(deadline) {
+				continue
+			}
+			c.history[p.Start.Unix()] = p
+			continue
+		}
+		if key != statsTotalsKey {
+			log.Println("stats:", "ignoring unknown record", key)
+			continue
+		}
+		var checkpoint statsCheckpoint
+		if err := json.Unmarshal(value, &checkpoint); err != nil {
+			return err
+		}
+		c.stats.FilesSent = checkpoint.FilesSent
+		c.stats.FilesSentBytes = checkpoint.FilesSentBytes
+		c.stats.FilesDownloaded = checkpoint.FilesDownloaded
+		c.stats.FilesDownloadedBytes = checkpoint.FilesDownloadedBytes
+		c.peaks = checkpoint.Peaks
+		for _, p := range checkpoint.Hour {
+			c.hour.restore(p)
+		}
+		for _, p := range checkpoint.Day {
+			c.day.restore(p)
+		}
+		c.lastSaved = checkpoint.Saved
+	}
+	return nil
+}
+
+// loadStats restores statistics from database
+func (s *DefaultServer) loadStats() {
+	records, err := s.db.StatsRecords()
+	if err == nil {
+		err = s.stats.restore(records, time.Now())
+	}
+	if err != nil {
+		log.Println("server:", "failed to load stats:", err)
+	}
+}
+
+// saveStats saves checkpoint of statistics to database
+func (s *DefaultServer) saveStats(now time.Time) error {
+	records, expired, err := s.stats.checkpoint(now)
+	if err != nil {
+		return err
+	}
+	for key, value := range records {
+		if err := s.db.SetStats([]byte(key), value); err != nil {
+			return err
+		}
+	}
+	for _, key := range expired {
+		if err := s.db.RemoveStats([]byte(key)); err != nil {
+			return err
+		}
+	}
+	s.stats.saved(now)
+	return nil
+}
+
+// statsLoop periodically saves statistics,
+// last time they are saved by Close
+func (s *DefaultServer) statsLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.cfg.StatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case t := <-ticker.C:
+			if err := s.saveStats(t); err != nil {
+				log.Println("server:", "failed to save stats:", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package hath
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStats(t *testing.T) {
+	Convey("Stats", t, func() {
+		c := newStatsCollector()
+		start := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+		sent := Event{Type: EventSent, File: File{Size: 100}}
+		downloaded := Event{Type: EventDownloaded, File: File{Size: 1000}}
+		c.process(sent, start)
+		c.process(sent, start.Add(time.Millisecond*500))
+		c.process(downloaded, start.Add(time.Second))
+		c.process(Event{Type: EventAdded, File: File{Size: 1000}}, start.Add(time.Second))
+
+		stats := c.get()
+		So(stats.FilesSent, ShouldEqual, 2)
+		So(stats.FilesSentBytes, ShouldEqual, 200)
+		So(stats.FilesDownloaded, ShouldEqual, 1)
+		So(stats.FilesTotal, ShouldEqual, 1)
+		So(stats.FilesTotalBytes, ShouldEqual, 1000)
+
+		Convey("Windows", func() {
+			snapshot := c.snapshot(start.Add(time.Second))
+			So(snapshot.Minute.Slot, ShouldEqual, time.Second)
+			So(snapshot.Minute.Points, ShouldHaveLength, statsMinuteSlots)
+			points := snapshot.Minute.Points
+			last := points[len(points)-1]
+			So(last.Start, ShouldResemble, start.Add(time.Second))
+			So(last.FilesDownloadedBytes, ShouldEqual, 1000)
+			So(points[len(points)-2].FilesSent, ShouldEqual, 2)
+			So(points[0].Start, ShouldResemble, start.Add(-time.Second*58))
+			So(snapshot.Hour.Total().FilesSentBytes, ShouldEqual, 200)
+			So(snapshot.Day.Points[statsDaySlots-1].Start, ShouldResemble, start)
+
+			// old slots are not reported after window passed them
+			later := start.Add(time.Minute * 2)
+			c.process(sent, later)
+			snapshot = c.snapshot(later)
+			So(snapshot.Minute.Total().FilesSent, ShouldEqual, 1)
+			So(snapshot.Minute.Total().FilesDownloaded, ShouldEqual, 0)
+			So(snapshot.Hour.Total().FilesSent, ShouldEqual, 3)
+			snapshot = c.snapshot(start.Add(time.Hour * 25))
+			So(snapshot.Day.Total().FilesSent, ShouldEqual, 0)
+			So(snapshot.Stats.FilesSent, ShouldEqual, 3)
+		})
+		Convey("Peaks", func() {
+			peaks := c.snapshot(start).Peaks
+			So(peaks.FilesSent.Rate, ShouldEqual, 2)
+			So(peaks.FilesSentBytes.Rate, ShouldEqual, 200)
+			So(peaks.FilesSentBytes.Time, ShouldResemble, start)
+			So(peaks.FilesDownloadedBytes.Rate, ShouldEqual, 1000)
+			So(peaks.FilesDownloadedBytes.Time, ShouldResemble, start.Add(time.Second))
+			c.process(sent, start.Add(time.Second*2))
+			So(c.snapshot(start).Peaks.FilesSent.Rate, ShouldEqual, 2)
+		})
+		Convey("Checkpoint", func() {
+			old := start.Add(-statsDay * statsHistoryDays)
+			c.process(sent, old)
+			now := start.Add(time.Second * 2)
+			records, expired, err := c.checkpoint(now)
+			So(err, ShouldBeNil)
+			So(expired, ShouldResemble, []string{statsDayKey(old.Truncate(statsDay))})
+			So(records, ShouldHaveLength, 2)
+			So(records, ShouldContainKey, statsDayKey(start.Truncate(statsDay)))
+			c.saved(now)
+			So(c.snapshot(now).History, ShouldHaveLength, 1)
+
+			restored := newStatsCollector()
+			So(restored.restore(records, now), ShouldBeNil)
+			snapshot := restored.snapshot(now)
+			expected := c.snapshot(now)
+			So(snapshot.Stats.FilesSent, ShouldEqual, 3)
+			So(snapshot.Stats.FilesDownloadedBytes, ShouldEqual, 1000)
+			So(snapshot.Peaks, ShouldResemble, expected.Peaks)
+			So(snapshot.Hour.Total(), ShouldResemble, expected.Hour.Total())
+			So(snapshot.Day.Total(), ShouldResemble, expected.Day.Total())
+			So(snapshot.History, ShouldHaveLength, 1)
+			So(snapshot.History[0].FilesSentBytes, ShouldEqual, 200)
+
+			// days expired while server was stopped are not restored
+			late := newStatsCollector()
+			So(late.restore(records, now.Add(statsDay*statsHistoryDays)), ShouldBeNil)
+			So(late.snapshot(now).History, ShouldHaveLength, 0)
+
+			// only days changed after last checkpoint are saved
+			records, _, err = c.checkpoint(now.Add(statsDay))
+			So(err, ShouldBeNil)
+			So(records, ShouldHaveLength, 2)
+			c.saved(now.Add(statsDay))
+			records, _, err = c.checkpoint(now.Add(statsDay))
+			So(err, ShouldBeNil)
+			So(records, ShouldHaveLength, 1)
+
+			So(restored.restore(map[string][]byte{statsTotalsKey: []byte("bad")}, now), ShouldNotBeNil)
+		})
+		Convey("Concurrent", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 100; j++ {
+						c.process(sent, time.Now())
+						c.snapshot(time.Now())
+						c.update(func(s *Stats) { s.DownloadsQueued++ })
+					}
+				}()
+			}
+			wg.Wait()
+			So(c.get().FilesSent, ShouldEqual, 402)
+			So(c.get().DownloadsQueued, ShouldEqual, 400)
+		})
+		Convey("Server", func() {
+			server, cleanup := newProxyServer(http.NotFoundHandler())
+			defer cleanup()
+			res, err := http.Get(server.url + "/api/stats/history")
+			So(err, ShouldBeNil)
+			defer res.Body.Close()
+			So(res.StatusCode, ShouldEqual, http.StatusOK)
+			var snapshot struct {
+				Stats struct{ Started time.Time }
+				Hour  StatsWindow
+			}
+			So(json.NewDecoder(res.Body).Decode(&snapshot), ShouldBeNil)
+			So(snapshot.Hour.Slot, ShouldEqual, time.Minute)
+			So(snapshot.Hour.Points, ShouldHaveLength, statsHourSlots)
+			So(snapshot.Stats.Started.IsZero(), ShouldBeFalse)
+		})
+		Convey("Restart", func() {
+			f, data := randomFile(1024)
+			server, cleanup := newProxyServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(data)
+			}))
+			defer cleanup()
+			res, err := http.Get(server.fileURL(f))
+			So(err, ShouldBeNil)
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			server.waitDownloads()
+			So(server.Close(), ShouldBeNil)
+
+			db, err := NewDB(path.Join(server.dir, "bolt.db"))
+			So(err, ShouldBeNil)
+			cfg := server.cfg
+			cfg.DataBase = db
+			restarted := NewServer(cfg)
+			restarted.headlessStart = true
+			So(restarted.Start(), ShouldBeNil)
+			defer restarted.Close()
+			stats := restarted.Stats()
+			So(stats.FilesSent, ShouldEqual, 1)
+			So(stats.FilesDownloadedBytes, ShouldEqual, 1024)
+			So(stats.FilesTotal, ShouldEqual, 1)
+			history := restarted.StatsSnapshot().History
+			So(history, ShouldHaveLength, 1)
+			So(history[0].FilesSent, ShouldEqual, 1)
+		})
+	})
+}
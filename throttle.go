@@ -0,0 +1,183 @@
+package hath
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// throttleChunkSize is maximum size of single write to limiter
+	throttleChunkSize = 32 * 1024
+)
+
+// Limiter is token bucket rate limiter for bytes,
+// bucket size is equal to rate, so one second of
+// traffic can be sent without waiting
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64 // bytes per second, 0 is unlimited
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates limiter with provided rate in bytes per second,
+// zero or negative rate means no limit
+func NewLimiter(rate int64) *Limiter {
+	l := new(Limiter)
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes rate of limiter, can be called concurrently
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = rate
+	l.tokens = float64(rate)
+	l.last = time.Now()
+}
+
+// Rate returns current rate in bytes per second
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// reserve takes n tokens from bucket and
+// returns duration to wait before sending n bytes
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	rate := float64(l.rate)
+	l.tokens += now.Sub(l.last).Seconds() * rate
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / rate * float64(time.Second))
+}
+
+// Wait blocks until n bytes can be sent
+func (l *Limiter) Wait(n int) {
+	if d := l.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// limitedWriter waits for all limiters before writing
+type limitedWriter struct {
+	w        io.Writer
+	limiters []*Limiter
+}
+
+// NewLimitedWriter returns writer that is limited by all provided limiters
+func NewLimitedWriter(w io.Writer, limiters ...*Limiter) io.Writer {
+	return limitedWriter{w, limiters}
+}
+
+func (w limitedWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > throttleChunkSize {
+			chunk = chunk[:throttleChunkSize]
+		}
+		for _, l := range w.limiters {
+			l.Wait(len(chunk))
+		}
+		written, err := w.w.Write(chunk)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// limitedReader waits for all limiters after reading
+type limitedReader struct {
+	r        io.Reader
+	limiters []*Limiter
+}
+
+// NewLimitedReader returns reader that is limited by all provided limiters
+func NewLimitedReader(r io.Reader, limiters ...*Limiter) io.Reader {
+	return limitedReader{r, limiters}
+}
+
+func (r limitedReader) Read(b []byte) (int, error) {
+	if len(b) > throttleChunkSize {
+		b = b[:throttleChunkSize]
+	}
+	n, err := r.r.Read(b)
+	for _, l := range r.limiters {
+		l.Wait(n)
+	}
+	return n, err
+}
+
+// throttledResponseWriter is gin.ResponseWriter with limited body writes
+type throttledResponseWriter struct {
+	gin.ResponseWriter
+	w io.Writer
+}
+
+func (w throttledResponseWriter) Write(b []byte) (int, error) {
+	return w.w.Write(b)
+}
+
+func (w throttledResponseWriter) WriteString(s string) (int, error) {
+	return w.w.Write([]byte(s))
+}
+
+// connLimiterKey is context key of per-connection limiter
+type connLimiterKey struct{}
+
+// connContext adds limiter of connection to its context, so
+// all requests of keep-alive connection share same limiter
+func (s *DefaultServer) connContext(ctx context.Context, _ net.Conn) context.Context {
+	if s.cfg.MaxConnectionBytesPerSecond <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, connLimiterKey{}, NewLimiter(s.cfg.MaxConnectionBytesPerSecond))
+}
+
+// throttle limits response bandwidth by global limiter and,
+// if configured, by per-connection limiter;
+// requests from rpc server are not limited
+func (s *DefaultServer) throttle(c *gin.Context) {
+	if s.settings().IsRPCServer(c.Request) {
+		c.Next()
+		return
+	}
+	limiters := []*Limiter{s.limiter}
+	if s.cfg.MaxConnectionBytesPerSecond > 0 {
+		l, ok := c.Request.Context().Value(connLimiterKey{}).(*Limiter)
+		if !ok {
+			// connection is not accepted by Listen,
+			// so only this request can be limited
+			l = NewLimiter(s.cfg.MaxConnectionBytesPerSecond)
+		}
+		limiters = append(limiters, l)
+	}
+	w := NewLimitedWriter(c.Writer, limiters...)
+	c.Writer = throttledResponseWriter{c.Writer, w}
+	c.Next()
+}
@@ -0,0 +1,115 @@
+package hath
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLimiter(t *testing.T) {
+	Convey("Limiter", t, func() {
+		var rate int64 = 1024 * 1024
+		data := make([]byte, rate+rate/2)
+		Convey("Limited", func() {
+			w := NewLimitedWriter(ioutil.Discard, NewLimiter(rate))
+			start := time.Now()
+			n, err := w.Write(data)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, len(data))
+			// first second of traffic is free
+			So(time.Since(start), ShouldBeGreaterThan, time.Millisecond*400)
+		})
+		Convey("Limited reader", func() {
+			r := NewLimitedReader(bytes.NewReader(data), NewLimiter(rate))
+			start := time.Now()
+			read, err := ioutil.ReadAll(r)
+			So(err, ShouldBeNil)
+			So(len(read), ShouldEqual, len(data))
+			So(time.Since(start), ShouldBeGreaterThan, time.Millisecond*400)
+		})
+		Convey("Unlimited", func() {
+			w := NewLimitedWriter(ioutil.Discard, NewLimiter(0))
+			start := time.Now()
+			n, err := w.Write(data)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, len(data))
+			So(time.Since(start), ShouldBeLessThan, time.Millisecond*100)
+		})
+		Convey("Connection", func() {
+			f, content := randomFile(16 * 1024)
+			server, cleanup := newProxyServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(content)
+			}), func(cfg *ServerConfig) {
+				cfg.MaxConnectionBytesPerSecond = int64(len(content))
+			})
+			defer cleanup()
+			get := func() time.Duration {
+				start := time.Now()
+				res, err := http.Get(server.fileURL(f))
+				So(err, ShouldBeNil)
+				defer res.Body.Close()
+				body, err := ioutil.ReadAll(res.Body)
+				So(err, ShouldBeNil)
+				So(body, ShouldResemble, content)
+				return time.Since(start)
+			}
+			So(get(), ShouldBeLessThan, time.Millisecond*500)
+			server.waitDownloads()
+
+			// keep-alive connection is reused and its bucket is empty
+			So(get(), ShouldBeGreaterThan, time.Millisecond*500)
+		})
+		Convey("Reconfigure", func() {
+			l := NewLimiter(rate)
+			So(l.Rate(), ShouldEqual, rate)
+			l.SetRate(0)
+			So(l.Rate(), ShouldEqual, 0)
+			So(l.reserve(len(data)*10), ShouldEqual, 0)
+			l.SetRate(-1)
+			So(l.Rate(), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestThrottleSettings(t *testing.T) {
+	Convey("Settings are refreshed while requests are throttled", t, func() {
+		gin.SetMode(gin.TestMode)
+		c := NewClient(ClientConfig{})
+		c.httpClient = stubClient{body: "OK\nport=1234\nthrottle_bytes=0\ndisklimit_bytes=0\nrpc_server_ip=127.0.0.1\nrequest_proxy_mode=4"}
+		s := new(DefaultServer)
+		s.api = c
+		s.limiter = NewLimiter(0)
+		e := gin.New()
+		e.Use(s.throttle)
+		e.GET("/", func(c *gin.Context) {
+			c.String(http.StatusOK, "OK")
+		})
+		var (
+			wg         sync.WaitGroup
+			refreshErr error
+		)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100 && refreshErr == nil; i++ {
+				refreshErr = s.refreshSettings()
+			}
+		}()
+		for i := 0; i < 100; i++ {
+			req := httptest.NewRequest(httpGET, "/", nil)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+		}
+		wg.Wait()
+		So(refreshErr, ShouldBeNil)
+		So(s.settings().Port, ShouldEqual, 1234)
+	})
+}